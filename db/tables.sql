@@ -10,6 +10,7 @@ CREATE TABLE "web_user" (
     password VARCHAR(255) NOT NULL,
     created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
     logged_in BOOLEAN NOT NULL DEFAULT FALSE,
+    is_admin BOOLEAN NOT NULL DEFAULT FALSE,
     refresh_token TEXT,
     refresh_token_expiry TIMESTAMP
 );
@@ -42,7 +43,7 @@ CREATE TABLE product_status (
 );
 
 
-INSERT INTO product_status (name) VALUES ('active'), ('sold'), ('reserved');
+INSERT INTO product_status (name) VALUES ('active'), ('sold'), ('reserved'), ('expired'), ('draft');
 
 CREATE TABLE product (
     id SERIAL PRIMARY KEY,
@@ -52,15 +53,35 @@ CREATE TABLE product (
     price NUMERIC(12, 2) NOT NULL,
     created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
     u_id UUID NOT NULL,
-    category_id INTEGER NOT NULL,
+    category_id INTEGER,
     status_id INTEGER NOT NULL DEFAULT 1, 
     condition VARCHAR(50),
     location VARCHAR(255),
+    shipping_option VARCHAR(20) NOT NULL DEFAULT 'pickup' CHECK (shipping_option IN ('pickup', 'shipping', 'both')),
+    shipping_cost NUMERIC(12, 2) NOT NULL DEFAULT 0 CHECK (shipping_cost >= 0),
+    expires_at TIMESTAMP WITH TIME ZONE,
+    publish_at TIMESTAMP WITH TIME ZONE,
+    -- Bumped on every update, used as the ETag for optimistic concurrency
+    version INTEGER NOT NULL DEFAULT 1,
+    -- Set when the owner deletes the product, it stays restorable until it is purged
+    deleted_at TIMESTAMP WITH TIME ZONE,
+    -- Only drafts may be saved without a category
+    CHECK (status_id = 5 OR category_id IS NOT NULL),
     FOREIGN KEY (u_id) REFERENCES web_user(u_id),
     FOREIGN KEY (category_id) REFERENCES category(id),
     FOREIGN KEY (status_id) REFERENCES product_status(id)
 );
 
+CREATE FUNCTION bump_product_version() RETURNS TRIGGER AS $$
+BEGIN
+    NEW.version := OLD.version + 1;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER product_version BEFORE UPDATE ON product
+    FOR EACH ROW EXECUTE FUNCTION bump_product_version();
+
 CREATE TABLE product_image (
     id SERIAL PRIMARY KEY,
     product_id UUID NOT NULL,
@@ -69,6 +90,34 @@ CREATE TABLE product_image (
     FOREIGN KEY (product_id) REFERENCES product(p_id) ON DELETE CASCADE
 );
 
+CREATE TABLE offer_status (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(50) NOT NULL UNIQUE
+);
+
+INSERT INTO offer_status (name) VALUES ('pending'), ('accepted'), ('declined'), ('countered'), ('expired');
+
+CREATE TABLE offer (
+    id SERIAL PRIMARY KEY,
+    o_id UUID NOT NULL UNIQUE DEFAULT uuid_generate_v4(),
+    product_id UUID NOT NULL,
+    buyer UUID NOT NULL,
+    seller UUID NOT NULL,
+    sender UUID NOT NULL,
+    amount NUMERIC(12, 2) NOT NULL CHECK (amount > 0),
+    status_id INTEGER NOT NULL DEFAULT 1,
+    parent_id UUID,
+    created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    responded_at TIMESTAMP WITH TIME ZONE,
+    FOREIGN KEY (product_id) REFERENCES product(p_id),
+    FOREIGN KEY (buyer) REFERENCES web_user(u_id),
+    FOREIGN KEY (seller) REFERENCES web_user(u_id),
+    FOREIGN KEY (sender) REFERENCES web_user(u_id),
+    FOREIGN KEY (status_id) REFERENCES offer_status(id),
+    FOREIGN KEY (parent_id) REFERENCES offer(o_id)
+);
+
 CREATE TABLE message (
     id SERIAL PRIMARY KEY,
     m_id UUID NOT NULL UNIQUE DEFAULT uuid_generate_v4(),
@@ -78,7 +127,242 @@ CREATE TABLE message (
     receiver UUID NOT NULL,
     product_id UUID NOT NULL,
     seen BOOLEAN DEFAULT FALSE,
+    type VARCHAR(20) NOT NULL DEFAULT 'text',
+    offer_id UUID,
+    emailed BOOLEAN NOT NULL DEFAULT FALSE,
     FOREIGN KEY (sender) REFERENCES web_user(u_id),
     FOREIGN KEY (receiver) REFERENCES web_user(u_id),
-    FOREIGN KEY (product_id) REFERENCES product(p_id)
-);
\ No newline at end of file
+    FOREIGN KEY (product_id) REFERENCES product(p_id),
+    FOREIGN KEY (offer_id) REFERENCES offer(o_id)
+);
+
+CREATE TABLE product_transaction (
+    id SERIAL PRIMARY KEY,
+    t_id UUID NOT NULL UNIQUE DEFAULT uuid_generate_v4(),
+    product_id UUID NOT NULL,
+    seller UUID NOT NULL,
+    buyer UUID NOT NULL,
+    price NUMERIC(12, 2) NOT NULL,
+    status_id INTEGER NOT NULL,
+    created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    reserved_at TIMESTAMP WITH TIME ZONE,
+    sold_at TIMESTAMP WITH TIME ZONE,
+    cancelled_at TIMESTAMP WITH TIME ZONE,
+    FOREIGN KEY (product_id) REFERENCES product(p_id),
+    FOREIGN KEY (seller) REFERENCES web_user(u_id),
+    FOREIGN KEY (buyer) REFERENCES web_user(u_id),
+    FOREIGN KEY (status_id) REFERENCES product_status(id)
+);
+
+-- A product can only be reserved for or sold to one buyer at a time
+CREATE UNIQUE INDEX product_transaction_open_idx ON product_transaction (product_id) WHERE cancelled_at IS NULL;
+
+CREATE TABLE review (
+    id SERIAL PRIMARY KEY,
+    r_id UUID NOT NULL UNIQUE DEFAULT uuid_generate_v4(),
+    transaction_id UUID NOT NULL,
+    reviewer UUID NOT NULL,
+    reviewee UUID NOT NULL,
+    rating SMALLINT NOT NULL CHECK (rating BETWEEN 1 AND 5),
+    content TEXT,
+    created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    response TEXT,
+    response_created TIMESTAMP WITH TIME ZONE,
+    UNIQUE (transaction_id, reviewer),
+    FOREIGN KEY (transaction_id) REFERENCES product_transaction(t_id),
+    FOREIGN KEY (reviewer) REFERENCES web_user(u_id),
+    FOREIGN KEY (reviewee) REFERENCES web_user(u_id)
+);
+
+CREATE TABLE address (
+    id SERIAL PRIMARY KEY,
+    a_id UUID NOT NULL UNIQUE DEFAULT uuid_generate_v4(),
+    u_id UUID NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    street VARCHAR(255) NOT NULL,
+    postal_code VARCHAR(20) NOT NULL,
+    city VARCHAR(255) NOT NULL,
+    country VARCHAR(100) NOT NULL,
+    phone VARCHAR(50),
+    is_default BOOLEAN NOT NULL DEFAULT FALSE,
+    created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (u_id) REFERENCES web_user(u_id)
+);
+
+CREATE UNIQUE INDEX address_default_idx ON address (u_id) WHERE is_default;
+
+CREATE TABLE order_status (
+    id SERIAL PRIMARY KEY,
+    name VARCHAR(50) NOT NULL UNIQUE
+);
+
+INSERT INTO order_status (name) VALUES ('pending'), ('paid'), ('shipped'), ('completed'), ('cancelled'), ('refunded'), ('disputed');
+
+CREATE TABLE product_order (
+    id SERIAL PRIMARY KEY,
+    ord_id UUID NOT NULL UNIQUE DEFAULT uuid_generate_v4(),
+    product_id UUID NOT NULL,
+    buyer UUID NOT NULL,
+    seller UUID NOT NULL,
+    amount NUMERIC(12, 2) NOT NULL,
+    status_id INTEGER NOT NULL DEFAULT 1,
+    payment_provider VARCHAR(50) NOT NULL,
+    payment_reference VARCHAR(255) UNIQUE,
+    created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    paid_at TIMESTAMP WITH TIME ZONE,
+    shipped_at TIMESTAMP WITH TIME ZONE,
+    completed_at TIMESTAMP WITH TIME ZONE,
+    cancelled_at TIMESTAMP WITH TIME ZONE,
+    refunded_at TIMESTAMP WITH TIME ZONE,
+    escrow BOOLEAN NOT NULL DEFAULT FALSE,
+    release_at TIMESTAMP WITH TIME ZONE,
+    released_at TIMESTAMP WITH TIME ZONE,
+    disputed_at TIMESTAMP WITH TIME ZONE,
+    dispute_reason TEXT,
+    resolved_at TIMESTAMP WITH TIME ZONE,
+    resolution VARCHAR(20),
+    shipping_method VARCHAR(20) NOT NULL DEFAULT 'pickup' CHECK (shipping_method IN ('pickup', 'shipping')),
+    shipping_cost NUMERIC(12, 2) NOT NULL DEFAULT 0,
+    shipping_address JSONB,
+    tracking_number VARCHAR(255),
+    carrier VARCHAR(100),
+    refund_status VARCHAR(20) CHECK (refund_status IN ('pending', 'done')),
+    refund_amount NUMERIC(12, 2),
+    FOREIGN KEY (product_id) REFERENCES product(p_id),
+    FOREIGN KEY (buyer) REFERENCES web_user(u_id),
+    FOREIGN KEY (seller) REFERENCES web_user(u_id),
+    FOREIGN KEY (status_id) REFERENCES order_status(id)
+);
+
+
+-- Double-entry ledger: every balance movement is one entry_id with a debit and a credit line
+-- summing to zero. A positive amount is money moving into the account.
+CREATE TABLE ledger_entry (
+    id SERIAL PRIMARY KEY,
+    entry_id UUID NOT NULL,
+    order_id UUID NOT NULL,
+    account VARCHAR(255) NOT NULL,
+    amount NUMERIC(12, 2) NOT NULL CHECK (amount <> 0),
+    description TEXT NOT NULL,
+    created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (order_id) REFERENCES product_order(ord_id)
+);
+
+CREATE INDEX ledger_entry_account_idx ON ledger_entry (account);
+
+CREATE TABLE watchlist (
+    id SERIAL PRIMARY KEY,
+    u_id UUID NOT NULL,
+    product_id UUID NOT NULL,
+    created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (u_id, product_id),
+    FOREIGN KEY (u_id) REFERENCES web_user(u_id),
+    FOREIGN KEY (product_id) REFERENCES product(p_id) ON DELETE CASCADE
+);
+
+CREATE TABLE notification (
+    id SERIAL PRIMARY KEY,
+    n_id UUID NOT NULL UNIQUE DEFAULT uuid_generate_v4(),
+    u_id UUID NOT NULL,
+    type VARCHAR(50) NOT NULL,
+    content TEXT NOT NULL,
+    product_id UUID,
+    seen BOOLEAN NOT NULL DEFAULT FALSE,
+    created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (u_id) REFERENCES web_user(u_id),
+    FOREIGN KEY (product_id) REFERENCES product(p_id) ON DELETE SET NULL
+);
+
+CREATE INDEX notification_user_idx ON notification (u_id, created DESC);
+
+CREATE TABLE saved_search (
+    id SERIAL PRIMARY KEY,
+    s_id UUID NOT NULL UNIQUE DEFAULT uuid_generate_v4(),
+    u_id UUID NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    query TEXT NOT NULL DEFAULT '',
+    category_id INTEGER,
+    min_price NUMERIC,
+    max_price NUMERIC,
+    condition VARCHAR(50),
+    location VARCHAR(255),
+    email_digest BOOLEAN NOT NULL DEFAULT FALSE,
+    created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (u_id) REFERENCES web_user(u_id),
+    FOREIGN KEY (category_id) REFERENCES category(id)
+);
+
+-- Products that matched a saved search, kept so email digests can pick up what was not mailed yet
+CREATE TABLE saved_search_hit (
+    id SERIAL PRIMARY KEY,
+    search_id UUID NOT NULL,
+    product_id UUID NOT NULL,
+    created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    emailed_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (search_id, product_id),
+    FOREIGN KEY (search_id) REFERENCES saved_search(s_id) ON DELETE CASCADE,
+    FOREIGN KEY (product_id) REFERENCES product(p_id) ON DELETE CASCADE
+);
+
+-- Users opt out of a channel per event type; a missing row means the channel is enabled
+CREATE TABLE notification_preference (
+    id SERIAL PRIMARY KEY,
+    u_id UUID NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    channel VARCHAR(20) NOT NULL,
+    enabled BOOLEAN NOT NULL,
+    UNIQUE (u_id, event_type, channel),
+    FOREIGN KEY (u_id) REFERENCES web_user(u_id)
+);
+
+CREATE TABLE push_subscription (
+    id SERIAL PRIMARY KEY,
+    s_id UUID NOT NULL UNIQUE DEFAULT uuid_generate_v4(),
+    u_id UUID NOT NULL,
+    endpoint TEXT NOT NULL UNIQUE,
+    p256dh TEXT NOT NULL,
+    auth TEXT NOT NULL,
+    device VARCHAR(255),
+    created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (u_id) REFERENCES web_user(u_id)
+);
+
+-- Every price a listing had, starting with the one it was created with
+CREATE TABLE price_history (
+    id SERIAL PRIMARY KEY,
+    product_id UUID NOT NULL,
+    price NUMERIC NOT NULL,
+    created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (product_id) REFERENCES product(p_id) ON DELETE CASCADE
+);
+
+CREATE INDEX price_history_product_idx ON price_history (product_id, created);
+
+CREATE TABLE product_view (
+    id BIGSERIAL PRIMARY KEY,
+    product_id UUID NOT NULL,
+    viewer UUID NOT NULL,
+    created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    FOREIGN KEY (product_id) REFERENCES product(p_id) ON DELETE CASCADE,
+    FOREIGN KEY (viewer) REFERENCES web_user(u_id)
+);
+
+CREATE INDEX product_view_product_idx ON product_view (product_id, viewer, created);
+
+CREATE TABLE import_job (
+    id SERIAL PRIMARY KEY,
+    j_id UUID NOT NULL UNIQUE DEFAULT uuid_generate_v4(),
+    u_id UUID NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'done', 'failed')),
+    total INTEGER NOT NULL DEFAULT 0,
+    succeeded INTEGER NOT NULL DEFAULT 0,
+    failed INTEGER NOT NULL DEFAULT 0,
+    results JSONB NOT NULL DEFAULT '[]',
+    error TEXT,
+    created TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    updated TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    finished TIMESTAMP WITH TIME ZONE,
+    FOREIGN KEY (u_id) REFERENCES web_user(u_id)
+);
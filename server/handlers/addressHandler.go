@@ -0,0 +1,286 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"ibuy-server/db"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type Address struct {
+	AddressID  string    `json:"addressId"`
+	Name       string    `json:"name"`
+	Street     string    `json:"street"`
+	PostalCode string    `json:"postalCode"`
+	City       string    `json:"city"`
+	Country    string    `json:"country"`
+	Phone      string    `json:"phone"`
+	IsDefault  bool      `json:"isDefault"`
+	Created    time.Time `json:"created"`
+}
+
+const addressColumns = "a_id, name, street, postal_code, city, country, phone, is_default, created"
+
+func scanAddress(row rowScanner) (Address, error) {
+	var address Address
+	var phone sql.NullString
+	err := row.Scan(
+		&address.AddressID,
+		&address.Name,
+		&address.Street,
+		&address.PostalCode,
+		&address.City,
+		&address.Country,
+		&phone,
+		&address.IsDefault,
+		&address.Created,
+	)
+	address.Phone = phone.String
+	return address, err
+}
+
+func (a Address) isComplete() bool {
+	return strings.TrimSpace(a.Name) != "" && strings.TrimSpace(a.Street) != "" &&
+		strings.TrimSpace(a.PostalCode) != "" && strings.TrimSpace(a.City) != "" &&
+		strings.TrimSpace(a.Country) != ""
+}
+
+func GetAddresses(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	rows, err := db.DB.Query(
+		"SELECT "+addressColumns+" FROM address WHERE u_id = $1 ORDER BY is_default DESC, created ASC",
+		userContext.UserId,
+	)
+	if err != nil {
+		log.Printf("Error querying addresses: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get addresses"})
+		return
+	}
+	defer rows.Close()
+
+	addresses := []Address{}
+	for rows.Next() {
+		address, err := scanAddress(rows)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get all address info"})
+			return
+		}
+		addresses = append(addresses, address)
+	}
+
+	if err = rows.Err(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read addresses"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(addresses); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+func AddAddress(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+	var userId = userContext.UserId
+
+	var newAddress Address
+	if err := json.NewDecoder(r.Body).Decode(&newAddress); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	defer r.Body.Close()
+
+	if !newAddress.isComplete() {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Name, street, postal code, city and country are required"})
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save address"})
+		return
+	}
+	defer tx.Rollback()
+
+	// The first address becomes the default one
+	var count int
+	if err := tx.QueryRow("SELECT COUNT(*) FROM address WHERE u_id = $1", userId).Scan(&count); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save address"})
+		return
+	}
+	if count == 0 {
+		newAddress.IsDefault = true
+	}
+
+	if newAddress.IsDefault {
+		if _, err := tx.Exec("UPDATE address SET is_default = FALSE WHERE u_id = $1 AND is_default", userId); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save address"})
+			return
+		}
+	}
+
+	address, err := scanAddress(tx.QueryRow(
+		"INSERT INTO address (u_id, name, street, postal_code, city, country, phone, is_default) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING "+addressColumns,
+		userId, newAddress.Name, newAddress.Street, newAddress.PostalCode, newAddress.City, newAddress.Country, newAddress.Phone, newAddress.IsDefault,
+	))
+	if err != nil {
+		log.Printf("Error saving address: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save address"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save address"})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+
+	if err := json.NewEncoder(w).Encode(address); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+func UpdateAddress(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+	var userId = userContext.UserId
+
+	addressId := r.PathValue("id")
+	if addressId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid address URL"})
+		return
+	}
+
+	var updatedAddress Address
+	if err := json.NewDecoder(r.Body).Decode(&updatedAddress); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	defer r.Body.Close()
+
+	if !updatedAddress.isComplete() {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Name, street, postal code, city and country are required"})
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update address"})
+		return
+	}
+	defer tx.Rollback()
+
+	if updatedAddress.IsDefault {
+		if _, err := tx.Exec("UPDATE address SET is_default = FALSE WHERE u_id = $1 AND is_default AND a_id <> $2", userId, addressId); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update address"})
+			return
+		}
+	}
+
+	address, err := scanAddress(tx.QueryRow(`
+		UPDATE address
+		SET name = $1, street = $2, postal_code = $3, city = $4, country = $5, phone = $6, is_default = $7 OR is_default
+		WHERE a_id = $8 AND u_id = $9
+		RETURNING `+addressColumns,
+		updatedAddress.Name, updatedAddress.Street, updatedAddress.PostalCode, updatedAddress.City,
+		updatedAddress.Country, updatedAddress.Phone, updatedAddress.IsDefault, addressId, userId,
+	))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Address not found"})
+			return
+		}
+		log.Printf("Error updating address: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update address"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update address"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(address); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+func DeleteAddress(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	addressId := r.PathValue("id")
+	if addressId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid address URL"})
+		return
+	}
+
+	// Orders keep their own copy of the address, so deleting it here is safe
+	result, err := db.DB.Exec("DELETE FROM address WHERE a_id = $1 AND u_id = $2", addressId, userContext.UserId)
+	if err != nil {
+		log.Printf("Error deleting address: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete address"})
+		return
+	}
+
+	if count, _ := result.RowsAffected(); count == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Address not found"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Address deleted successfully"})
+}
@@ -0,0 +1,242 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"ibuy-server/db"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type ViewConfig struct {
+	DedupWindow time.Duration // repeated views by the same user within this window count once
+}
+
+// NewViewConfig creates a default view counting configuration
+func NewViewConfig() *ViewConfig {
+	return &ViewConfig{
+		DedupWindow: 30 * time.Minute,
+	}
+}
+
+var Views = NewViewConfig()
+
+type productView struct {
+	productId string
+	viewer    string
+}
+
+// viewEvents buffers views waiting to be written, further views are dropped when it is full
+var viewEvents = make(chan productView, 1024)
+
+const (
+	defaultAnalyticsDays = 30
+	maxAnalyticsDays     = 365
+)
+
+type DailyStats struct {
+	Date           string `json:"date"`
+	Views          int    `json:"views"`
+	MessageThreads int    `json:"messageThreads"`
+}
+
+type ProductAnalytics struct {
+	ProductID      string       `json:"productId"`
+	Name           string       `json:"name"`
+	Status         int          `json:"status"`
+	Views          int          `json:"views"`
+	UniqueViewers  int          `json:"uniqueViewers"`
+	Watchers       int          `json:"watchers"`
+	MessageThreads int          `json:"messageThreads"`
+	ConversionRate float64      `json:"conversionRate"` // share of unique viewers that started a conversation
+	Daily          []DailyStats `json:"daily"`
+}
+
+// recordView queues a view without blocking the request
+func recordView(productId, viewer string) {
+	select {
+	case viewEvents <- productView{productId: productId, viewer: viewer}:
+	default:
+		log.Printf("View of %s by %s dropped", productId, viewer)
+	}
+}
+
+// RunViewRecorder writes queued product views, skipping repeats within the dedup window
+func RunViewRecorder(config *ViewConfig) {
+	for view := range viewEvents {
+		_, err := db.DB.Exec(`
+			INSERT INTO product_view (product_id, viewer)
+			SELECT $1, $2
+			WHERE NOT EXISTS (
+				SELECT 1 FROM product_view WHERE product_id = $1 AND viewer = $2 AND created > $3
+			)`,
+			view.productId, view.viewer, time.Now().Add(-config.DedupWindow),
+		)
+		if err != nil {
+			log.Printf("Error recording view of %s: %v", view.productId, err)
+		}
+	}
+}
+
+// GetAnalytics returns view, watcher and conversation statistics for the current user's
+// listings, with a daily breakdown over the last days (30 by default)
+func GetAnalytics(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+	var userId = userContext.UserId
+
+	days := defaultAnalyticsDays
+	if d, err := strconv.Atoi(r.URL.Query().Get("days")); err == nil && d > 0 {
+		days = min(d, maxAnalyticsDays)
+	}
+	today := time.Now().UTC().Truncate(24 * time.Hour)
+	since := today.AddDate(0, 0, -days+1)
+
+	// A message thread is the conversation between the seller and one other user about a product
+	rows, err := db.DB.Query(`
+		SELECT
+			p.p_id,
+			p.name,
+			p.status_id,
+			(SELECT COUNT(*) FROM product_view v WHERE v.product_id = p.p_id),
+			(SELECT COUNT(DISTINCT v.viewer) FROM product_view v WHERE v.product_id = p.p_id),
+			(SELECT COUNT(*) FROM watchlist wl WHERE wl.product_id = p.p_id),
+			(SELECT COUNT(DISTINCT CASE WHEN m.sender = p.u_id THEN m.receiver ELSE m.sender END) FROM message m WHERE m.product_id = p.p_id)
+		FROM product p
+		WHERE p.u_id = $1 AND p.deleted_at IS NULL
+		ORDER BY p.created DESC`,
+		userId,
+	)
+	if err != nil {
+		log.Printf("Error querying analytics: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get analytics"})
+		return
+	}
+	defer rows.Close()
+
+	analytics := []ProductAnalytics{}
+	index := map[string]int{}
+	for rows.Next() {
+		var product ProductAnalytics
+		err := rows.Scan(
+			&product.ProductID,
+			&product.Name,
+			&product.Status,
+			&product.Views,
+			&product.UniqueViewers,
+			&product.Watchers,
+			&product.MessageThreads,
+		)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get all analytics info"})
+			return
+		}
+		if product.UniqueViewers > 0 {
+			product.ConversionRate = float64(product.MessageThreads) / float64(product.UniqueViewers)
+		}
+
+		product.Daily = make([]DailyStats, days)
+		for i := range product.Daily {
+			product.Daily[i].Date = since.AddDate(0, 0, i).Format(time.DateOnly)
+		}
+
+		index[product.ProductID] = len(analytics)
+		analytics = append(analytics, product)
+	}
+
+	if err = rows.Err(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read analytics"})
+		return
+	}
+
+	dailyViews, err := db.DB.Query(`
+		SELECT v.product_id, to_char(v.created AT TIME ZONE 'UTC', 'YYYY-MM-DD'), COUNT(*)
+		FROM product_view v
+		INNER JOIN product p ON v.product_id = p.p_id
+		WHERE p.u_id = $1 AND v.created >= $2
+		GROUP BY 1, 2`,
+		userId, since,
+	)
+	if err != nil {
+		log.Printf("Error querying daily views: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get analytics"})
+		return
+	}
+	err = addDailyStats(dailyViews, analytics, index, since, func(day *DailyStats, count int) { day.Views = count })
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read analytics"})
+		return
+	}
+
+	dailyThreads, err := db.DB.Query(`
+		SELECT t.product_id, to_char(t.started AT TIME ZONE 'UTC', 'YYYY-MM-DD'), COUNT(*)
+		FROM (
+			SELECT m.product_id, MIN(m.created) AS started
+			FROM message m
+			INNER JOIN product p ON m.product_id = p.p_id
+			WHERE p.u_id = $1
+			GROUP BY m.product_id, CASE WHEN m.sender = p.u_id THEN m.receiver ELSE m.sender END
+		) t
+		WHERE t.started >= $2
+		GROUP BY 1, 2`,
+		userId, since,
+	)
+	if err != nil {
+		log.Printf("Error querying daily message threads: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get analytics"})
+		return
+	}
+	err = addDailyStats(dailyThreads, analytics, index, since, func(day *DailyStats, count int) { day.MessageThreads = count })
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read analytics"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(analytics); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+// addDailyStats reads (product, date, count) rows into the daily breakdown of each product
+func addDailyStats(rows *sql.Rows, analytics []ProductAnalytics, index map[string]int, since time.Time, set func(*DailyStats, int)) error {
+	defer rows.Close()
+
+	for rows.Next() {
+		var productId, date string
+		var count int
+		if err := rows.Scan(&productId, &date, &count); err != nil {
+			return err
+		}
+
+		i, ok := index[productId]
+		if !ok {
+			continue
+		}
+		day, err := time.Parse(time.DateOnly, date)
+		if err != nil {
+			return err
+		}
+		offset := int(day.Sub(since).Hours() / 24)
+		if offset >= 0 && offset < len(analytics[i].Daily) {
+			set(&analytics[i].Daily[offset], count)
+		}
+	}
+	return rows.Err()
+}
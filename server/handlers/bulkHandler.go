@@ -0,0 +1,271 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ibuy-server/db"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Bulk actions
+const (
+	BulkChangeStatus   = "status"
+	BulkChangePrice    = "price"
+	BulkChangeCategory = "category"
+	BulkDelete         = "delete"
+)
+
+const maxBulkProducts = 100
+
+// ErrBulkItem marks a problem with a single product of a bulk request, its message is shown to the user
+var ErrBulkItem = errors.New("bulk item rejected")
+
+// bulkStatuses are the statuses listings can be moved to in bulk or by PATCH. Selling or
+// reserving records the buyer, which only UpdateProduct, offers and orders do.
+var bulkStatuses = []int{StatusActive}
+
+type BulkRequest struct {
+	ProductIDs []string `json:"productIds"`
+	Action     string   `json:"action"`
+	Status     int      `json:"status"`     // for BulkChangeStatus
+	Percentage float32  `json:"percentage"` // for BulkChangePrice, e.g. -10 lowers prices by 10%
+	Category   int      `json:"category"`   // for BulkChangeCategory
+}
+
+type BulkItemResult struct {
+	ProductID string `json:"productId"`
+	OK        bool   `json:"ok"`
+	Error     string `json:"error,omitempty"`
+}
+
+type BulkResponse struct {
+	Applied bool             `json:"applied"`
+	Results []BulkItemResult `json:"results"`
+}
+
+// bulkEffect is what has to happen once a bulk change is committed
+type bulkEffect struct {
+	productId, name string
+	oldPrice        float32
+	newPrice        float32
+	oldStatus       int
+	newStatus       int
+}
+
+// BulkUpdateProducts applies one action to several of the user's listings. All products
+// are changed in one transaction: if any of them fails nothing is applied, and the
+// results say which products were the problem.
+func BulkUpdateProducts(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+	var userId = userContext.UserId
+
+	var req BulkRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	defer r.Body.Close()
+
+	if len(req.ProductIDs) == 0 || len(req.ProductIDs) > maxBulkProducts {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": fmt.Sprintf("Between 1 and %d products are required", maxBulkProducts)})
+		return
+	}
+
+	switch req.Action {
+	case BulkChangeStatus:
+		if req.Status == StatusSold || req.Status == StatusReserved {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Products are sold or reserved one at a time, together with their buyer"})
+			return
+		}
+		if !slices.Contains(bulkStatuses, req.Status) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid status value"})
+			return
+		}
+	case BulkChangePrice:
+		if req.Percentage == 0 || req.Percentage <= -100 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Percentage must be above -100 and not 0"})
+			return
+		}
+	case BulkChangeCategory:
+		var exists bool
+		if err := db.DB.QueryRow("SELECT EXISTS (SELECT 1 FROM category WHERE id = $1)", req.Category).Scan(&exists); err != nil || !exists {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid category value"})
+			return
+		}
+	case BulkDelete:
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Unknown action, expected status, price, category or delete"})
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update products"})
+		return
+	}
+	defer tx.Rollback()
+
+	response := BulkResponse{Results: make([]BulkItemResult, 0, len(req.ProductIDs))}
+	var effects []bulkEffect
+	failed := false
+	seen := map[string]bool{}
+	for _, productId := range req.ProductIDs {
+		result := BulkItemResult{ProductID: productId}
+
+		// After the first failure the transaction is aborted, the rest is only reported
+		switch {
+		case seen[productId]:
+			result.Error = "Duplicate product"
+			failed = true
+		case failed:
+			result.Error = "Not applied"
+		default:
+			effect, err := applyBulkAction(tx, userId, productId, req)
+			if err != nil {
+				failed = true
+				if errors.Is(err, ErrBulkItem) {
+					result.Error = strings.TrimSuffix(err.Error(), ": "+ErrBulkItem.Error())
+				} else {
+					log.Printf("Error applying bulk %s to %s: %v", req.Action, productId, err)
+					result.Error = "Failed to update product"
+				}
+			} else {
+				result.OK = true
+				effects = append(effects, effect)
+			}
+		}
+		seen[productId] = true
+		response.Results = append(response.Results, result)
+	}
+
+	if failed {
+		// Nothing was applied, so no product counts as done
+		for i := range response.Results {
+			if response.Results[i].OK {
+				response.Results[i].OK = false
+				response.Results[i].Error = "Not applied"
+			}
+		}
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(response)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update products"})
+		return
+	}
+	response.Applied = true
+
+	for _, effect := range effects {
+		effect.apply()
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+// applyBulkAction changes a single product inside the bulk transaction
+func applyBulkAction(tx *sql.Tx, userId, productId string, req BulkRequest) (bulkEffect, error) {
+	effect := bulkEffect{productId: productId}
+	var ownerId string
+	err := tx.QueryRow(
+		"SELECT u_id, name, price, status_id FROM product WHERE p_id = $1 AND deleted_at IS NULL FOR UPDATE",
+		productId,
+	).Scan(&ownerId, &effect.name, &effect.oldPrice, &effect.oldStatus)
+	if err == sql.ErrNoRows {
+		return effect, fmt.Errorf("Product not found: %w", ErrBulkItem)
+	}
+	if err != nil {
+		return effect, err
+	}
+	if ownerId != userId {
+		return effect, fmt.Errorf("Not Authorized: %w", ErrBulkItem)
+	}
+	effect.newPrice = effect.oldPrice
+	effect.newStatus = effect.oldStatus
+
+	switch req.Action {
+	case BulkChangeStatus:
+		if effect.oldStatus == StatusDraft {
+			return effect, fmt.Errorf("Drafts have to be published first: %w", ErrBulkItem)
+		}
+		if req.Status != effect.oldStatus {
+			openOrder, err := productHasOpenOrder(tx, productId)
+			if err != nil {
+				return effect, err
+			}
+			if openOrder {
+				return effect, fmt.Errorf("Product has an open order: %w", ErrBulkItem)
+			}
+		}
+		effect.newStatus = req.Status
+		_, err = tx.Exec(
+			"UPDATE product SET status_id = $1, expires_at = CASE WHEN $1 = $2 AND status_id = $3 THEN $4 ELSE expires_at END WHERE p_id = $5",
+			req.Status, StatusActive, StatusExpired, time.Now().Add(Expiry.ListingPeriod), productId,
+		)
+		if err == nil && req.Status == StatusActive {
+			err = cancelOpenTransactionTx(tx, productId, userId)
+		}
+
+	case BulkChangePrice:
+		price := float32(math.Round(float64(effect.oldPrice)*(100+float64(req.Percentage))) / 100)
+		effect.newPrice = price
+		if price != effect.oldPrice {
+			_, err = tx.Exec("UPDATE product SET price = $1 WHERE p_id = $2", price, productId)
+			if err == nil {
+				err = recordPrice(tx, productId, price)
+			}
+		}
+
+	case BulkChangeCategory:
+		_, err = tx.Exec("UPDATE product SET category_id = $1 WHERE p_id = $2", req.Category, productId)
+
+	case BulkDelete:
+		// Moved to the trash like a single delete, the purge job removes it later
+		err = trashProduct(tx, productId)
+		if err == ErrProductInUse {
+			return effect, fmt.Errorf("Products with an open order or reservation cannot be deleted: %w", ErrBulkItem)
+		}
+	}
+	return effect, err
+}
+
+// apply runs the side effects of a committed change, watchers hear about price drops
+// and status changes
+func (e bulkEffect) apply() {
+	if e.newPrice < e.oldPrice {
+		go notifyWatchers(e.productId, NotificationPriceDrop,
+			fmt.Sprintf("%s dropped in price from %.2f to %.2f", e.name, e.oldPrice, e.newPrice))
+	}
+	if e.newStatus != e.oldStatus {
+		go notifyWatchers(e.productId, NotificationStatusChange,
+			fmt.Sprintf("%s is now %s", e.name, productStatusName(e.newStatus)))
+	}
+}
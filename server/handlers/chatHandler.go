@@ -19,6 +19,8 @@ type ChatMessage struct {
 	Receiver 	string    `json:"receiver"`
 	ProductId 	string 	  `json:"productId"`
 	Seen     	bool      `json:"seen"`
+	Type     	string    `json:"type"`
+	Offer    	*Offer    `json:"offer,omitempty"`
 }
 
 type SendMessageRequest struct {
@@ -35,6 +37,7 @@ type Chat struct {
 	ProductTitle     string `json:"productTitle"`
 	ProductImage     string `json:"productImage"`
 	UnseenCount      int    `json:"unseenCount"`
+	ProductRemoved   bool   `json:"productRemoved"` // the listing was deleted, the chat stays readable
 }
 
 var ChatHub *websocket.Hub
@@ -75,10 +78,14 @@ func SendMessage(w http.ResponseWriter, r *http.Request){
 		Sender:   senderId,
 		Receiver: req.Receiver,
 		ProductId: req.ProductId,
+		Silent:   !notificationEnabled(req.Receiver, NotificationMessage, ChannelWebsocket),
 	}
 
 	ChatHub.RegisterMessage(wsMessage)
-	
+	// Online receivers already get the message over the websocket
+	if !ChatHub.IsOnline(req.Receiver) {
+		notifyAsync(req.Receiver, NotificationMessage, req.Content, req.ProductId)
+	}
 
 	response := ChatMessage{
 		MID:      messageId,
@@ -88,6 +95,7 @@ func SendMessage(w http.ResponseWriter, r *http.Request){
 		Receiver: req.Receiver,
 		ProductId: req.ProductId,
 		Seen:     false,
+		Type:     "text",
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -140,6 +148,7 @@ func GetUserChats(w http.ResponseWriter, r *http.Request){
 		m.product_id,
 		p.name AS product_title,
 		pi.image_path AS product_image,
+		p.deleted_at IS NOT NULL AS product_removed,
 		COUNT(*) FILTER (WHERE NOT m.seen AND m.receiver = $1) AS unseen_count
 	FROM message m
 	INNER JOIN web_user wu ON m.sender = wu.u_id
@@ -152,7 +161,7 @@ func GetUserChats(w http.ResponseWriter, r *http.Request){
 		LIMIT 1
 	) pi ON true
 	WHERE m.receiver = $1
-	GROUP BY wu.first_name, wu.last_name, wu.u_id, m.sender, m.receiver, m.product_id, p.name, pi.image_path
+	GROUP BY wu.first_name, wu.last_name, wu.u_id, m.sender, m.receiver, m.product_id, p.name, p.deleted_at, pi.image_path
 	ORDER BY 
 		LEAST(m.sender, m.receiver),
 		GREATEST(m.sender, m.receiver),
@@ -179,6 +188,7 @@ func GetUserChats(w http.ResponseWriter, r *http.Request){
 			&chat.ProductId,
 			&chat.ProductTitle,
 			&productImage,
+			&chat.ProductRemoved,
 			&chat.UnseenCount,
 		)
 		if err != nil {
@@ -229,15 +239,19 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Query messages between the two users
+	// Query messages between the two users, with offer events joined to their offer.
+	// Pending offers past their expiry show as expired before the expirer got to them.
 	query := `
-		SELECT id, m_id, content, created, sender, receiver, seen 
-		FROM message 
-		WHERE ((sender = $1 AND receiver = $2) OR (sender = $2 AND receiver = $1)) AND product_id = $3
-		ORDER BY created ASC
+		SELECT m.id, m.m_id, m.content, m.created, m.sender, m.receiver, m.seen, m.type,
+			o.o_id, o.buyer, o.seller, o.sender, o.amount,
+			CASE WHEN o.status_id = $4 AND o.expires_at < NOW() THEN $5 ELSE o.status_id END, o.parent_id, o.created, o.expires_at, o.responded_at
+		FROM message m
+		LEFT JOIN offer o ON m.offer_id = o.o_id
+		WHERE ((m.sender = $1 AND m.receiver = $2) OR (m.sender = $2 AND m.receiver = $1)) AND m.product_id = $3
+		ORDER BY m.created ASC
 	`
 
-	rows, err := db.DB.Query(query, senderId, otherUserID, productId)
+	rows, err := db.DB.Query(query, senderId, otherUserID, productId, OfferPending, OfferExpired)
 	if err != nil {
 		log.Printf("Error querying messages: %v", err)
 		http.Error(w, "Failed to retrieve messages", http.StatusInternalServerError)
@@ -248,11 +262,36 @@ func GetMessages(w http.ResponseWriter, r *http.Request) {
 	var messages []ChatMessage
 	for rows.Next() {
 		var msg ChatMessage
-		err := rows.Scan(&msg.ID, &msg.MID, &msg.Content, &msg.Created, &msg.Sender, &msg.Receiver, &msg.Seen)
+		var offerId, offerBuyer, offerSeller, offerSender, offerParent sql.NullString
+		var offerAmount sql.NullFloat64
+		var offerStatus sql.NullInt64
+		var offerCreated, offerExpires, offerResponded sql.NullTime
+		err := rows.Scan(&msg.ID, &msg.MID, &msg.Content, &msg.Created, &msg.Sender, &msg.Receiver, &msg.Seen, &msg.Type,
+			&offerId, &offerBuyer, &offerSeller, &offerSender, &offerAmount, &offerStatus, &offerParent, &offerCreated, &offerExpires, &offerResponded)
 		if err != nil {
 			log.Printf("Error scanning message: %v", err)
 			continue
 		}
+		msg.ProductId = productId
+
+		if offerId.Valid {
+			msg.Offer = &Offer{
+				OfferID:   offerId.String,
+				ProductID: productId,
+				Buyer:     offerBuyer.String,
+				Seller:    offerSeller.String,
+				Sender:    offerSender.String,
+				Amount:    float32(offerAmount.Float64),
+				Status:    int(offerStatus.Int64),
+				ParentID:  offerParent.String,
+				Created:   offerCreated.Time,
+				ExpiresAt: offerExpires.Time,
+			}
+			if offerResponded.Valid {
+				msg.Offer.RespondedAt = &offerResponded.Time
+			}
+		}
+
 		messages = append(messages, msg)
 	}
 
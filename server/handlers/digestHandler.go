@@ -0,0 +1,189 @@
+package handlers
+
+import (
+	"fmt"
+	"ibuy-server/db"
+	"ibuy-server/mail"
+	"log"
+	"strings"
+	"time"
+)
+
+// Mailer sends outgoing email, the log backend is used until main configures another one
+var Mailer mail.Mailer = mail.LogMailer{}
+
+type DigestConfig struct {
+	Delay         time.Duration // how long a message stays unread before it goes into a digest
+	CheckInterval time.Duration // how often the digest mailer looks for unread messages
+}
+
+// NewDigestConfig creates a default digest configuration
+func NewDigestConfig() *DigestConfig {
+	return &DigestConfig{
+		Delay:         30 * time.Minute,
+		CheckInterval: 5 * time.Minute,
+	}
+}
+
+var Digest = NewDigestConfig()
+
+// RunDigestMailer periodically emails offline users a digest of their unread
+// messages and of new listings matching saved searches with email digests on.
+func RunDigestMailer(config *DigestConfig) {
+	ticker := time.NewTicker(config.CheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sendDigests(time.Now().Add(-config.Delay))
+	}
+}
+
+func sendDigests(cutoff time.Time) {
+	rows, err := db.DB.Query(`
+		SELECT receiver FROM message
+		WHERE NOT seen AND NOT emailed AND created <= $1
+		UNION
+		SELECT s.u_id FROM saved_search_hit h
+		INNER JOIN saved_search s ON h.search_id = s.s_id
+		WHERE s.email_digest AND h.emailed_at IS NULL AND h.created <= $1`,
+		cutoff,
+	)
+	if err != nil {
+		log.Printf("Error querying digest recipients: %v", err)
+		return
+	}
+
+	var userIds []string
+	for rows.Next() {
+		var userId string
+		if err := rows.Scan(&userId); err == nil {
+			userIds = append(userIds, userId)
+		}
+	}
+	rows.Close()
+
+	for _, userId := range userIds {
+		// Users that are online see their messages as they arrive
+		if ChatHub.IsOnline(userId) {
+			continue
+		}
+		if err := sendDigest(userId, cutoff); err != nil {
+			log.Printf("Error sending digest to %s: %v", userId, err)
+		}
+	}
+}
+
+// sendDigest mails one user everything pending up to cutoff and marks it as emailed.
+// Items the user does not want by email are marked too, so they are not picked up again.
+func sendDigest(userId string, cutoff time.Time) error {
+	var email, firstName string
+	err := db.DB.QueryRow("SELECT email, first_name FROM web_user WHERE u_id = $1", userId).Scan(&email, &firstName)
+	if err != nil {
+		return err
+	}
+
+	var sections []string
+
+	if notificationEnabled(userId, NotificationMessage, ChannelEmail) {
+		lines, err := unreadMessageLines(userId, cutoff)
+		if err != nil {
+			return err
+		}
+		if len(lines) > 0 {
+			sections = append(sections, "Unread messages:\n"+strings.Join(lines, "\n"))
+		}
+	}
+
+	if notificationEnabled(userId, NotificationSavedSearch, ChannelEmail) {
+		lines, err := savedSearchHitLines(userId, cutoff)
+		if err != nil {
+			return err
+		}
+		if len(lines) > 0 {
+			sections = append(sections, "New listings for your saved searches:\n"+strings.Join(lines, "\n"))
+		}
+	}
+
+	if len(sections) > 0 {
+		err := Mailer.Send(mail.Message{
+			To:      email,
+			Subject: "What you missed on iBuy",
+			Body:    fmt.Sprintf("Hi %s,\n\n%s\n", firstName, strings.Join(sections, "\n\n")),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := db.DB.Exec(
+		"UPDATE message SET emailed = TRUE WHERE receiver = $1 AND NOT seen AND NOT emailed AND created <= $2",
+		userId, cutoff,
+	); err != nil {
+		return err
+	}
+
+	_, err = db.DB.Exec(`
+		UPDATE saved_search_hit h SET emailed_at = $3
+		FROM saved_search s
+		WHERE h.search_id = s.s_id AND s.u_id = $1 AND s.email_digest AND h.emailed_at IS NULL AND h.created <= $2`,
+		userId, cutoff, time.Now(),
+	)
+	return err
+}
+
+// unreadMessageLines summarises a user's unread messages per sender and product
+func unreadMessageLines(userId string, cutoff time.Time) ([]string, error) {
+	rows, err := db.DB.Query(`
+		SELECT u.first_name || ' ' || u.last_name, p.name, COUNT(*)
+		FROM message m
+		INNER JOIN web_user u ON m.sender = u.u_id
+		INNER JOIN product p ON m.product_id = p.p_id
+		WHERE m.receiver = $1 AND NOT m.seen AND NOT m.emailed AND m.created <= $2
+		GROUP BY u.first_name, u.last_name, p.name
+		ORDER BY MAX(m.created) DESC`,
+		userId, cutoff,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var sender, product string
+		var count int
+		if err := rows.Scan(&sender, &product, &count); err != nil {
+			return nil, err
+		}
+		lines = append(lines, fmt.Sprintf("- %d unread message(s) from %s about %s", count, sender, product))
+	}
+	return lines, rows.Err()
+}
+
+// savedSearchHitLines lists the new listings matching a user's saved searches
+func savedSearchHitLines(userId string, cutoff time.Time) ([]string, error) {
+	rows, err := db.DB.Query(`
+		SELECT s.name, p.name, p.price
+		FROM saved_search_hit h
+		INNER JOIN saved_search s ON h.search_id = s.s_id
+		INNER JOIN product p ON h.product_id = p.p_id
+		WHERE s.u_id = $1 AND s.email_digest AND h.emailed_at IS NULL AND h.created <= $2 AND p.deleted_at IS NULL
+		ORDER BY h.created DESC`,
+		userId, cutoff,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var lines []string
+	for rows.Next() {
+		var search, product string
+		var price float32
+		if err := rows.Scan(&search, &product, &price); err != nil {
+			return nil, err
+		}
+		lines = append(lines, fmt.Sprintf("- %s (%.2f) for \"%s\"", product, price, search))
+	}
+	return lines, rows.Err()
+}
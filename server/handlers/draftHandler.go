@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"ibuy-server/db"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type PublishConfig struct {
+	CheckInterval time.Duration // how often the publisher looks for scheduled drafts
+}
+
+// NewPublishConfig creates a default scheduled publishing configuration
+func NewPublishConfig() *PublishConfig {
+	return &PublishConfig{
+		CheckInterval: time.Minute,
+	}
+}
+
+var Publishing = NewPublishConfig()
+
+type PublishRequest struct {
+	PublishAt *time.Time `json:"publishAt"` // publish later instead of right away
+}
+
+// missingListingFields lists what a draft still needs before it can be published
+func missingListingFields(name string, category sql.NullInt32) []string {
+	var missing []string
+	if strings.TrimSpace(name) == "" {
+		missing = append(missing, "name")
+	}
+	if !category.Valid {
+		missing = append(missing, "category")
+	}
+	return missing
+}
+
+// publishDraft puts a draft on sale and starts its listing period. It returns
+// sql.ErrNoRows when the product is not a draft (anymore).
+func publishDraft(productId string) (ProductResponse, error) {
+	var product ProductResponse
+	expiresAt := time.Now().Add(Expiry.ListingPeriod)
+	err := db.DB.QueryRow(`
+		UPDATE product SET status_id = $1, publish_at = NULL, expires_at = $2, created = NOW()
+		WHERE p_id = $3 AND status_id = $4
+		RETURNING p_id, u_id, name, price, category_id, COALESCE(condition, ''), status_id, COALESCE(location, ''), COALESCE(description, ''), created`,
+		StatusActive, expiresAt, productId, StatusDraft,
+	).Scan(
+		&product.ProductID,
+		&product.UserID,
+		&product.Name,
+		&product.Price,
+		&product.Category,
+		&product.Condition,
+		&product.Status,
+		&product.Location,
+		&product.Description,
+		&product.Created,
+	)
+	if err != nil {
+		return product, err
+	}
+	product.ExpiresAt = &expiresAt
+
+	go matchSavedSearches(product)
+	return product, nil
+}
+
+// PublishProduct publishes a draft right away, or schedules it when publishAt is given
+func PublishProduct(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	productId := r.PathValue("id")
+	if productId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid product URL"})
+		return
+	}
+
+	// The body is optional, without it the draft is published right away
+	var req PublishRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	defer r.Body.Close()
+
+	var name string
+	var category sql.NullInt32
+	var status int
+	err := db.DB.QueryRow(
+		"SELECT name, category_id, status_id FROM product WHERE p_id = $1 AND u_id = $2 AND deleted_at IS NULL",
+		productId, userContext.UserId,
+	).Scan(&name, &category, &status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to publish product"})
+		return
+	}
+
+	if status != StatusDraft {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Product is already published"})
+		return
+	}
+
+	if missing := missingListingFields(name, category); len(missing) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Missing required fields: " + strings.Join(missing, ", ")})
+		return
+	}
+
+	if req.PublishAt != nil && req.PublishAt.After(time.Now()) {
+		if _, err := db.DB.Exec("UPDATE product SET publish_at = $1 WHERE p_id = $2", *req.PublishAt, productId); err != nil {
+			log.Printf("Error scheduling product: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to schedule product"})
+			return
+		}
+
+		w.WriteHeader(http.StatusOK)
+		json.NewEncoder(w).Encode(map[string]any{"message": "Product scheduled", "publishAt": req.PublishAt})
+		return
+	}
+
+	product, err := publishDraft(productId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Product is already published"})
+			return
+		}
+		log.Printf("Error publishing product: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to publish product"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(product); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+func RunScheduledPublisher(config *PublishConfig) {
+	ticker := time.NewTicker(config.CheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		publishScheduledDrafts()
+	}
+}
+
+// publishScheduledDrafts publishes drafts whose time has come. Drafts that were edited
+// into an incomplete state after scheduling are unscheduled and their seller is told.
+func publishScheduledDrafts() {
+	rows, err := db.DB.Query(
+		"SELECT p_id, u_id, name, category_id FROM product WHERE status_id = $1 AND publish_at <= $2 AND deleted_at IS NULL",
+		StatusDraft, time.Now(),
+	)
+	if err != nil {
+		log.Printf("Error querying scheduled drafts: %v", err)
+		return
+	}
+
+	type draft struct {
+		productId, sellerId, name string
+		category                  sql.NullInt32
+	}
+	var drafts []draft
+	for rows.Next() {
+		var d draft
+		if err := rows.Scan(&d.productId, &d.sellerId, &d.name, &d.category); err == nil {
+			drafts = append(drafts, d)
+		}
+	}
+	rows.Close()
+
+	for _, d := range drafts {
+		if missing := missingListingFields(d.name, d.category); len(missing) > 0 {
+			if _, err := db.DB.Exec("UPDATE product SET publish_at = NULL WHERE p_id = $1", d.productId); err != nil {
+				log.Printf("Error unscheduling draft %s: %v", d.productId, err)
+				continue
+			}
+			content := fmt.Sprintf("Your draft could not be published, it is missing: %s", strings.Join(missing, ", "))
+			if err := notify(d.sellerId, NotificationStatusChange, content, d.productId); err != nil {
+				log.Printf("Error notifying seller of draft %s: %v", d.productId, err)
+			}
+			continue
+		}
+
+		if _, err := publishDraft(d.productId); err != nil && err != sql.ErrNoRows {
+			log.Printf("Error publishing scheduled draft %s: %v", d.productId, err)
+			continue
+		}
+		log.Printf("Published scheduled draft %s", d.productId)
+	}
+}
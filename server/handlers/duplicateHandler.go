@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"ibuy-server/db"
+	"ibuy-server/imaging"
+	"log"
+	"net/http"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// insertProduct stores a new listing with the given status. Active listings start
+// their listing period right away.
+func insertProduct(q queryer, userId string, newProduct NewProduct, status int) (ProductResponse, error) {
+	product := ProductResponse{
+		UserID:         userId,
+		Name:           newProduct.Name,
+		Price:          newProduct.Price,
+		Category:       newProduct.Category,
+		Condition:      newProduct.Condition,
+		Status:         status,
+		Location:       newProduct.Location,
+		Description:    newProduct.Description,
+		ShippingOption: newProduct.ShippingOption,
+		ShippingCost:   newProduct.ShippingCost,
+		Images:         []string{},
+	}
+	if status == StatusActive {
+		expiresAt := time.Now().Add(Expiry.ListingPeriod)
+		product.ExpiresAt = &expiresAt
+	}
+
+	err := q.QueryRow(
+		"INSERT INTO product (name, description, price, u_id, category_id, status_id, condition, location, shipping_option, shipping_cost, expires_at) VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6, $7, $8, $9, $10, $11) RETURNING p_id, created",
+		newProduct.Name, newProduct.Description, newProduct.Price, userId, newProduct.Category, status, newProduct.Condition, newProduct.Location,
+		newProduct.ShippingOption, newProduct.ShippingCost, product.ExpiresAt,
+	).Scan(&product.ProductID, &product.Created)
+	if err != nil {
+		return product, err
+	}
+
+	return product, recordPrice(q, product.ProductID, newProduct.Price)
+}
+
+// addProductImages links stored image files to a product
+func addProductImages(e execer, productId string, imagePaths []string) error {
+	if len(imagePaths) == 0 {
+		return nil
+	}
+	_, err := e.Exec("INSERT INTO product_image (product_id, image_path) SELECT $1, UNNEST($2::text[])", productId, pq.Array(imagePaths))
+	return err
+}
+
+// storedNamePrefix is what saveImageFile puts in front of a name, older files only have the timestamp
+var storedNamePrefix = regexp.MustCompile(`^\d+_([0-9a-f]{16}_)?`)
+
+// copyImageFile stores a copy of an existing image for another product
+func copyImageFile(imagePath, productId, userId string) (string, error) {
+	data, err := readImageFile(imagePath)
+	if err != nil {
+		return "", err
+	}
+	// Stored images passed validation when they were uploaded
+	img, err := imaging.Decode(data)
+	if err != nil {
+		return "", err
+	}
+
+	// saveImageFile adds its own unique prefix
+	name := storedNamePrefix.ReplaceAllString(filepath.Base(imagePath), "")
+	savedPath, err := saveImageFile(img, name, productId, userId)
+	if err != nil {
+		return "", err
+	}
+	return strings.ReplaceAll(savedPath, "\\", "/"), nil
+}
+
+// DuplicateProduct copies one of the user's listings, including its images, into a new draft
+func DuplicateProduct(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+	var userId = userContext.UserId
+
+	productId := r.PathValue("id")
+	if productId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid product URL"})
+		return
+	}
+
+	var original NewProduct
+	var imagePathsStr sql.NullString
+	err := db.DB.QueryRow(`
+		SELECT p.name, COALESCE(p.description, ''), p.price, COALESCE(p.category_id, 0), COALESCE(p.condition, ''),
+			COALESCE(p.location, ''), p.shipping_option, p.shipping_cost,
+			(SELECT string_agg(pi.image_path, ',') FROM product_image pi WHERE pi.product_id = p.p_id)
+		FROM product p
+		WHERE p.p_id = $1 AND p.u_id = $2 AND p.deleted_at IS NULL`,
+		productId, userId,
+	).Scan(
+		&original.Name,
+		&original.Description,
+		&original.Price,
+		&original.Category,
+		&original.Condition,
+		&original.Location,
+		&original.ShippingOption,
+		&original.ShippingCost,
+		&imagePathsStr,
+	)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to duplicate product"})
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to duplicate product"})
+		return
+	}
+	defer tx.Rollback()
+
+	// The copy starts as a draft so it can be adjusted before it goes on sale
+	product, err := insertProduct(tx, userId, original, StatusDraft)
+	if err != nil {
+		log.Printf("Error duplicating product: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to duplicate product"})
+		return
+	}
+
+	if imagePathsStr.Valid && imagePathsStr.String != "" {
+		for _, imagePath := range strings.Split(imagePathsStr.String, ",") {
+			copied, err := copyImageFile(imagePath, product.ProductID, userId)
+			if err != nil {
+				// A copy without all of its images is not a duplicate
+				log.Printf("Error copying image %s: %v", imagePath, err)
+				discardImageFiles(product.Images)
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to copy product images"})
+				return
+			}
+			product.Images = append(product.Images, copied)
+		}
+	}
+
+	if err := addProductImages(tx, product.ProductID, product.Images); err != nil {
+		discardImageFiles(product.Images)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save product images"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		discardImageFiles(product.Images)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to duplicate product"})
+		return
+	}
+	product.setImageVariants()
+
+	w.WriteHeader(http.StatusCreated)
+
+	if err := json.NewEncoder(w).Encode(product); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
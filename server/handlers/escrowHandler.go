@@ -0,0 +1,594 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"ibuy-server/db"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Ledger accounts. Sellers each have their own account named sellerAccount(userId).
+const (
+	AccountExternal = "external" // money outside the platform, i.e. at the payment provider
+	AccountEscrow   = "escrow"   // money held on behalf of buyers until release
+	AccountRefunds  = "refunds"  // money owed back to buyers until the payment provider paid it
+)
+
+// Dispute resolutions an admin can choose
+const (
+	ResolutionRelease = "release"
+	ResolutionRefund  = "refund"
+)
+
+// EscrowConfig holds configuration for escrow holding and release
+type EscrowConfig struct {
+	MinAmount     float32       // orders at or above this amount are held in escrow
+	ReleaseAfter  time.Duration // time after shipping until funds are released without buyer confirmation
+	CheckInterval time.Duration // how often the releaser looks for due orders
+}
+
+// NewEscrowConfig creates a default escrow configuration
+func NewEscrowConfig() *EscrowConfig {
+	return &EscrowConfig{
+		MinAmount:     100,
+		ReleaseAfter:  14 * 24 * time.Hour,
+		CheckInterval: 10 * time.Minute,
+	}
+}
+
+var Escrow = NewEscrowConfig()
+
+type DisputeRequest struct {
+	Reason string `json:"reason"`
+}
+
+type ResolveDisputeRequest struct {
+	Resolution string `json:"resolution"`
+}
+
+type LedgerEntry struct {
+	EntryID     string    `json:"entryId"`
+	OrderID     string    `json:"orderId"`
+	Account     string    `json:"account"`
+	Amount      float32   `json:"amount"`
+	Description string    `json:"description"`
+	Created     time.Time `json:"created"`
+}
+
+type Balance struct {
+	Account string        `json:"account"`
+	Balance float32       `json:"balance"`
+	Entries []LedgerEntry `json:"entries"`
+}
+
+type LedgerReport struct {
+	Balanced          bool               `json:"balanced"`
+	Total             float64            `json:"total"`
+	UnbalancedEntries []string           `json:"unbalancedEntries"`
+	Balances          map[string]float64 `json:"balances"`
+}
+
+func sellerAccount(userId string) string {
+	return "seller:" + userId
+}
+
+// postLedgerEntry moves an amount between two accounts as one balanced entry:
+// a negative line on the source account and a positive line on the destination.
+func postLedgerEntry(tx *sql.Tx, orderId, description, from, to string, amount float32) error {
+	_, err := tx.Exec(`
+		WITH entry AS (SELECT uuid_generate_v4() AS entry_id)
+		INSERT INTO ledger_entry (entry_id, order_id, account, amount, description)
+		SELECT entry_id, $1, $2, -$4::numeric, $5 FROM entry
+		UNION ALL
+		SELECT entry_id, $1, $3, $4::numeric, $5 FROM entry`,
+		orderId, from, to, amount, description,
+	)
+	return err
+}
+
+// releaseEscrow pays the held funds of an order out to the seller
+func releaseEscrow(tx *sql.Tx, order *Order, now time.Time) error {
+	if err := postLedgerEntry(tx, order.OrderID, "Escrow released", AccountEscrow, sellerAccount(order.Seller), order.Amount); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE product_order SET released_at = $1 WHERE ord_id = $2", now, order.OrderID); err != nil {
+		return err
+	}
+	order.ReleasedAt = &now
+	return nil
+}
+
+// settleOrderFunds records the money movements caused by an order status change.
+// Payments always enter escrow; orders below the escrow threshold are released right away,
+// the others when the buyer confirms receipt, the release timeout elapses or an admin decides.
+func settleOrderFunds(tx *sql.Tx, order *Order, status int, now time.Time) error {
+	switch status {
+	case OrderPaid:
+		if err := postLedgerEntry(tx, order.OrderID, "Payment received", AccountExternal, AccountEscrow, order.Amount); err != nil {
+			return err
+		}
+		if !order.Escrow {
+			return releaseEscrow(tx, order, now)
+		}
+	case OrderCompleted:
+		if order.ReleasedAt == nil {
+			return releaseEscrow(tx, order, now)
+		}
+	case OrderRefunded:
+		// The provider is only asked to pay back once this is committed, see refundOrder
+		from := AccountEscrow
+		if order.ReleasedAt != nil {
+			from = sellerAccount(order.Seller)
+		}
+		if err := postLedgerEntry(tx, order.OrderID, "Refund requested", from, AccountRefunds, order.Amount); err != nil {
+			return err
+		}
+		if _, err := tx.Exec("UPDATE product_order SET refund_status = $1, refund_amount = $2 WHERE ord_id = $3", RefundPending, order.Amount, order.OrderID); err != nil {
+			return err
+		}
+		order.RefundStatus = RefundPending
+		order.RefundAmount = order.Amount
+	}
+	return nil
+}
+
+// holdUnexpectedPayment books a payment that cannot be applied to its order, because the
+// order was cancelled meanwhile or the amount does not match, as owed back to the buyer.
+// A still pending order is cancelled. The provider pays back once this is committed.
+func holdUnexpectedPayment(tx *sql.Tx, order *Order, amount float32) error {
+	if order.Status == OrderPending {
+		if err := transitionOrder(tx, order, OrderCancelled); err != nil {
+			return err
+		}
+	}
+	if err := postLedgerEntry(tx, order.OrderID, "Unexpected payment received", AccountExternal, AccountRefunds, amount); err != nil {
+		return err
+	}
+	if _, err := tx.Exec("UPDATE product_order SET refund_status = $1, refund_amount = $2 WHERE ord_id = $3", RefundPending, amount, order.OrderID); err != nil {
+		return err
+	}
+	order.RefundStatus = RefundPending
+	order.RefundAmount = amount
+	return nil
+}
+
+// refundOrder has the payment provider pay back an order's pending refund and marks it done.
+// It runs after the refund was committed as pending, so a failed call can simply be retried;
+// the idempotency key keeps the provider from paying twice.
+func refundOrder(order *Order) error {
+	if Payments == nil {
+		return errors.New("no payment provider configured")
+	}
+	if err := Payments.Refund(order.PaymentReference, order.RefundAmount, "refund-"+order.OrderID); err != nil {
+		return err
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		"UPDATE product_order SET refund_status = $1, updated = $2 WHERE ord_id = $3 AND refund_status = $4",
+		RefundDone, time.Now(), order.OrderID, RefundPending,
+	)
+	if err != nil {
+		return err
+	}
+	// Another attempt may have finished the refund in the meantime
+	if updated, err := result.RowsAffected(); err != nil || updated == 0 {
+		return err
+	}
+	if err := postLedgerEntry(tx, order.OrderID, "Payment refunded", AccountRefunds, AccountExternal, order.RefundAmount); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	order.RefundStatus = RefundDone
+	return nil
+}
+
+// refundResponseStatus pays back a just refunded order and tells whether that went through.
+// Accepted means the refund is pending and will be retried.
+func refundResponseStatus(order *Order) int {
+	if order.RefundStatus != RefundPending {
+		return http.StatusOK
+	}
+	if err := refundOrder(order); err != nil {
+		log.Printf("Error refunding order %s, will retry: %v", order.OrderID, err)
+		return http.StatusAccepted
+	}
+	return http.StatusOK
+}
+
+// DisputeOrder freezes the held funds of an escrow order until an admin resolves the dispute
+func DisputeOrder(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+	var userId = userContext.UserId
+
+	orderId := r.PathValue("id")
+	if orderId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid order URL"})
+		return
+	}
+
+	var req DisputeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Reason) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "A dispute reason is required"})
+		return
+	}
+	defer r.Body.Close()
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to open dispute"})
+		return
+	}
+	defer tx.Rollback()
+
+	order, err := scanOrder(tx.QueryRow("SELECT "+orderColumns+" FROM product_order WHERE ord_id = $1 FOR UPDATE", orderId))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Order not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to open dispute"})
+		return
+	}
+
+	if userId != order.Buyer && userId != order.Seller {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not Authorized"})
+		return
+	}
+
+	if !order.Escrow || order.ReleasedAt != nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Order has no funds held in escrow"})
+		return
+	}
+
+	if err := transitionOrder(tx, &order, OrderDisputed); err != nil {
+		if err == ErrInvalidOrderTransition {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Order cannot be disputed"})
+			return
+		}
+		log.Printf("Error disputing order: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to open dispute"})
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE product_order SET dispute_reason = $1 WHERE ord_id = $2", req.Reason, orderId); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to open dispute"})
+		return
+	}
+	order.DisputeReason = req.Reason
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to open dispute"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(order); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+// ResolveDispute lets an admin either release the held funds to the seller or refund the buyer
+func ResolveDispute(w http.ResponseWriter, r *http.Request) {
+	orderId := r.PathValue("id")
+	if orderId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid order URL"})
+		return
+	}
+
+	var req ResolveDisputeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	defer r.Body.Close()
+
+	var status int
+	switch req.Resolution {
+	case ResolutionRelease:
+		status = OrderCompleted
+	case ResolutionRefund:
+		status = OrderRefunded
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Resolution must be release or refund"})
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to resolve dispute"})
+		return
+	}
+	defer tx.Rollback()
+
+	order, err := scanOrder(tx.QueryRow("SELECT "+orderColumns+" FROM product_order WHERE ord_id = $1 FOR UPDATE", orderId))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Order not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to resolve dispute"})
+		return
+	}
+
+	if order.Status != OrderDisputed {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Order is not disputed"})
+		return
+	}
+
+	if err := transitionOrder(tx, &order, status); err != nil {
+		log.Printf("Error resolving dispute: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to resolve dispute"})
+		return
+	}
+
+	now := time.Now()
+	if _, err := tx.Exec("UPDATE product_order SET resolved_at = $1, resolution = $2 WHERE ord_id = $3", now, req.Resolution, orderId); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to resolve dispute"})
+		return
+	}
+	order.ResolvedAt = &now
+	order.Resolution = req.Resolution
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to resolve dispute"})
+		return
+	}
+
+	w.WriteHeader(refundResponseStatus(&order))
+
+	if err := json.NewEncoder(w).Encode(order); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+// GetBalance returns the current user's seller balance and the ledger lines behind it
+func GetBalance(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	balance := Balance{
+		Account: sellerAccount(userContext.UserId),
+		Entries: []LedgerEntry{},
+	}
+
+	rows, err := db.DB.Query(
+		"SELECT entry_id, order_id, account, amount, description, created FROM ledger_entry WHERE account = $1 ORDER BY created DESC",
+		balance.Account,
+	)
+	if err != nil {
+		log.Printf("Error querying ledger: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get balance"})
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entry LedgerEntry
+		if err := rows.Scan(&entry.EntryID, &entry.OrderID, &entry.Account, &entry.Amount, &entry.Description, &entry.Created); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get all ledger info"})
+			return
+		}
+		balance.Balance += entry.Amount
+		balance.Entries = append(balance.Entries, entry)
+	}
+
+	if err = rows.Err(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read ledger"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(balance); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+// ReconcileLedger checks that every entry and the ledger as a whole sum to zero
+func ReconcileLedger(w http.ResponseWriter, r *http.Request) {
+	report := LedgerReport{
+		UnbalancedEntries: []string{},
+		Balances:          make(map[string]float64),
+	}
+
+	rows, err := db.DB.Query("SELECT entry_id FROM ledger_entry GROUP BY entry_id HAVING SUM(amount) <> 0")
+	if err != nil {
+		log.Printf("Error reconciling ledger: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to reconcile ledger"})
+		return
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var entryId string
+		if err := rows.Scan(&entryId); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to reconcile ledger"})
+			return
+		}
+		report.UnbalancedEntries = append(report.UnbalancedEntries, entryId)
+	}
+
+	balanceRows, err := db.DB.Query("SELECT account, SUM(amount) FROM ledger_entry GROUP BY account")
+	if err != nil {
+		log.Printf("Error reconciling ledger: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to reconcile ledger"})
+		return
+	}
+	defer balanceRows.Close()
+
+	for balanceRows.Next() {
+		var account string
+		var amount float64
+		if err := balanceRows.Scan(&account, &amount); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to reconcile ledger"})
+			return
+		}
+		report.Balances[account] = amount
+	}
+
+	// Summed in the database so NUMERIC precision decides, not float rounding
+	var ledgerZero bool
+	err = db.DB.QueryRow("SELECT COALESCE(SUM(amount), 0), COALESCE(SUM(amount), 0) = 0 FROM ledger_entry").Scan(&report.Total, &ledgerZero)
+	if err != nil {
+		log.Printf("Error reconciling ledger: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to reconcile ledger"})
+		return
+	}
+
+	report.Balanced = len(report.UnbalancedEntries) == 0 && ledgerZero
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+// RunEscrowReleaser periodically completes shipped escrow orders whose release timeout
+// elapsed without the buyer confirming receipt or opening a dispute. It also retries
+// refunds the payment provider did not pay out yet.
+func RunEscrowReleaser(config *EscrowConfig) {
+	ticker := time.NewTicker(config.CheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		releaseDueEscrows()
+		retryPendingRefunds()
+	}
+}
+
+func retryPendingRefunds() {
+	rows, err := db.DB.Query("SELECT "+orderColumns+" FROM product_order WHERE refund_status = $1", RefundPending)
+	if err != nil {
+		log.Printf("Error querying pending refunds: %v", err)
+		return
+	}
+
+	var orders []Order
+	for rows.Next() {
+		if order, err := scanOrder(rows); err == nil {
+			orders = append(orders, order)
+		}
+	}
+	rows.Close()
+
+	for _, order := range orders {
+		if err := refundOrder(&order); err != nil {
+			log.Printf("Error refunding order %s: %v", order.OrderID, err)
+			continue
+		}
+		log.Printf("Refund paid out for order %s", order.OrderID)
+	}
+}
+
+func releaseDueEscrows() {
+	rows, err := db.DB.Query(
+		"SELECT ord_id FROM product_order WHERE escrow AND status_id = $1 AND released_at IS NULL AND release_at <= $2",
+		OrderShipped, time.Now(),
+	)
+	if err != nil {
+		log.Printf("Error querying due escrows: %v", err)
+		return
+	}
+
+	var orderIds []string
+	for rows.Next() {
+		var orderId string
+		if err := rows.Scan(&orderId); err == nil {
+			orderIds = append(orderIds, orderId)
+		}
+	}
+	rows.Close()
+
+	for _, orderId := range orderIds {
+		if err := releaseDueEscrow(orderId); err != nil {
+			log.Printf("Error releasing escrow for order %s: %v", orderId, err)
+			continue
+		}
+		log.Printf("Escrow released for order %s after timeout", orderId)
+	}
+}
+
+func releaseDueEscrow(orderId string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	order, err := scanOrder(tx.QueryRow("SELECT "+orderColumns+" FROM product_order WHERE ord_id = $1 FOR UPDATE", orderId))
+	if err != nil {
+		return err
+	}
+
+	// A dispute or confirmation may have happened since the order was selected
+	if order.Status != OrderShipped || order.ReleasedAt != nil {
+		return nil
+	}
+
+	if err := transitionOrder(tx, &order, OrderCompleted); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
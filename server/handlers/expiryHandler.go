@@ -0,0 +1,124 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"ibuy-server/db"
+	"log"
+	"net/http"
+	"time"
+)
+
+const NotificationListingExpired = "listing_expired"
+
+type ExpiryConfig struct {
+	ListingPeriod time.Duration // how long a listing stays active before it has to be renewed
+	CheckInterval time.Duration // how often the expirer looks for due listings
+}
+
+// NewExpiryConfig creates a default listing expiry configuration
+func NewExpiryConfig() *ExpiryConfig {
+	return &ExpiryConfig{
+		ListingPeriod: 30 * 24 * time.Hour,
+		CheckInterval: time.Hour,
+	}
+}
+
+var Expiry = NewExpiryConfig()
+
+// RenewProduct puts an active or expired listing on sale for another listing period
+func RenewProduct(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	productId := r.PathValue("id")
+	if productId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid product URL"})
+		return
+	}
+
+	var status int
+	err := db.DB.QueryRow("SELECT status_id FROM product WHERE p_id = $1 AND u_id = $2 AND deleted_at IS NULL", productId, userContext.UserId).Scan(&status)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to renew product"})
+		return
+	}
+
+	if status != StatusActive && status != StatusExpired {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Only active or expired listings can be renewed"})
+		return
+	}
+
+	expiresAt := time.Now().Add(Expiry.ListingPeriod)
+	_, err = db.DB.Exec(
+		"UPDATE product SET status_id = $1, expires_at = $2 WHERE p_id = $3 AND status_id IN ($4, $1)",
+		StatusActive, expiresAt, productId, StatusExpired,
+	)
+	if err != nil {
+		log.Printf("Error renewing product: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to renew product"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]any{"message": "Product renewed", "expiresAt": expiresAt})
+}
+
+func RunListingExpirer(config *ExpiryConfig) {
+	ticker := time.NewTicker(config.CheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		expireListings()
+	}
+}
+
+// expireListings moves active listings past their expiry date to expired and tells their sellers
+func expireListings() {
+	rows, err := db.DB.Query(
+		"UPDATE product SET status_id = $1 WHERE status_id = $2 AND expires_at <= $3 AND deleted_at IS NULL RETURNING p_id, u_id, name",
+		StatusExpired, StatusActive, time.Now(),
+	)
+	if err != nil {
+		log.Printf("Error expiring listings: %v", err)
+		return
+	}
+
+	type expiredListing struct {
+		productId, sellerId, name string
+	}
+	var expired []expiredListing
+	for rows.Next() {
+		var listing expiredListing
+		if err := rows.Scan(&listing.productId, &listing.sellerId, &listing.name); err == nil {
+			expired = append(expired, listing)
+		}
+	}
+	rows.Close()
+
+	for _, listing := range expired {
+		content := fmt.Sprintf("%s has expired, renew it to put it back on sale", listing.name)
+		if err := notify(listing.sellerId, NotificationListingExpired, content, listing.productId); err != nil {
+			log.Printf("Error notifying seller of expired listing %s: %v", listing.productId, err)
+		}
+		notifyWatchers(listing.productId, NotificationStatusChange,
+			fmt.Sprintf("%s is now %s", listing.name, productStatusName(StatusExpired)))
+	}
+	if len(expired) > 0 {
+		log.Printf("Expired %d listings", len(expired))
+	}
+}
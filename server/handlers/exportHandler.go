@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"ibuy-server/db"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportFlushRows is how many listings are written before the response is flushed
+const exportFlushRows = 100
+
+var exportColumns = []string{
+	"id", "name", "description", "price", "category", "condition", "location", "status",
+	"shipping_option", "shipping_cost", "created", "expires_at", "publish_at", "images",
+}
+
+type ExportedProduct struct {
+	ProductID      string     `json:"productId"`
+	Name           string     `json:"name"`
+	Description    string     `json:"description"`
+	Price          float32    `json:"price"`
+	Category       string     `json:"category"`
+	Condition      string     `json:"condition"`
+	Location       string     `json:"location"`
+	Status         string     `json:"status"`
+	ShippingOption string     `json:"shippingOption"`
+	ShippingCost   float32    `json:"shippingCost"`
+	Created        time.Time  `json:"created"`
+	ExpiresAt      *time.Time `json:"expiresAt"`
+	PublishAt      *time.Time `json:"publishAt"`
+	Images         []string   `json:"images"`
+}
+
+// csvRecord returns the product in exportColumns order. Category and images use the
+// same format as the CSV import, so an export can be imported again.
+func (p ExportedProduct) csvRecord() []string {
+	formatTime := func(t *time.Time) string {
+		if t == nil {
+			return ""
+		}
+		return t.Format(time.RFC3339)
+	}
+	return []string{
+		p.ProductID,
+		p.Name,
+		p.Description,
+		strconv.FormatFloat(float64(p.Price), 'f', 2, 32),
+		p.Category,
+		p.Condition,
+		p.Location,
+		p.Status,
+		p.ShippingOption,
+		strconv.FormatFloat(float64(p.ShippingCost), 'f', 2, 32),
+		p.Created.Format(time.RFC3339),
+		formatTime(p.ExpiresAt),
+		formatTime(p.PublishAt),
+		strings.Join(p.Images, ";"),
+	}
+}
+
+// PublicURL is the address clients reach this server at, e.g. https://ibuy.example.com.
+// Exported links to images served by this server stay relative while it is not set.
+var PublicURL string
+
+// imageURL turns a stored image path into an absolute URL, on this server unless
+// the image store has a public address. The request's Host and forwarding headers
+// are not trusted for this, exports are shared outside the session.
+func imageURL(imagePath string) string {
+	url := Images.URL(filepath.ToSlash(imagePath))
+	if !strings.HasPrefix(url, "/") {
+		return url
+	}
+	return strings.TrimSuffix(PublicURL, "/") + url
+}
+
+// ExportProducts streams every listing of the current user as CSV or JSON
+// (?format=csv|json). Rows are written as they are read from the database.
+func ExportProducts(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	if format != "csv" && format != "json" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid format, expected csv or json"})
+		return
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT
+			p.p_id,
+			p.name,
+			p.description,
+			p.price,
+			COALESCE(c.name, ''),
+			p.condition,
+			p.location,
+			ps.name,
+			p.shipping_option,
+			p.shipping_cost,
+			p.created,
+			p.expires_at,
+			p.publish_at,
+			(SELECT string_agg(pi.image_path, ',' ORDER BY pi.uploaded_at) FROM product_image pi WHERE pi.product_id = p.p_id) AS image_paths
+		FROM product p
+		JOIN product_status ps ON ps.id = p.status_id
+		LEFT JOIN category c ON c.id = p.category_id
+		WHERE p.u_id = $1 AND p.deleted_at IS NULL
+		ORDER BY p.created`,
+		userContext.UserId,
+	)
+	if err != nil {
+		log.Printf("Error querying products for export: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to export products"})
+		return
+	}
+	defer rows.Close()
+
+	filename := fmt.Sprintf("listings-%s.%s", time.Now().Format("2006-01-02"), format)
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+	}
+	w.WriteHeader(http.StatusOK)
+
+	// Headers are sent, from here on errors can only be logged
+	controller := http.NewResponseController(w)
+	csvWriter := csv.NewWriter(w)
+	encoder := json.NewEncoder(w)
+	if format == "csv" {
+		csvWriter.Write(exportColumns)
+	} else {
+		w.Write([]byte("["))
+	}
+
+	count := 0
+	for rows.Next() {
+		var product ExportedProduct
+		var expiresAt, publishAt sql.NullTime
+		var imagePathsStr sql.NullString
+		err := rows.Scan(
+			&product.ProductID,
+			&product.Name,
+			&product.Description,
+			&product.Price,
+			&product.Category,
+			&product.Condition,
+			&product.Location,
+			&product.Status,
+			&product.ShippingOption,
+			&product.ShippingCost,
+			&product.Created,
+			&expiresAt,
+			&publishAt,
+			&imagePathsStr,
+		)
+		if err != nil {
+			log.Printf("Error scanning exported product: %v", err)
+			return
+		}
+		product.ExpiresAt = nullTimePtr(expiresAt)
+		product.PublishAt = nullTimePtr(publishAt)
+		product.Images = []string{}
+		if imagePathsStr.Valid && imagePathsStr.String != "" {
+			for _, imagePath := range strings.Split(imagePathsStr.String, ",") {
+				product.Images = append(product.Images, imageURL(imagePath))
+			}
+		}
+
+		if format == "csv" {
+			err = csvWriter.Write(product.csvRecord())
+		} else {
+			if count > 0 {
+				w.Write([]byte(","))
+			}
+			err = encoder.Encode(product)
+		}
+		if err != nil {
+			log.Printf("Error writing export: %v", err)
+			return
+		}
+
+		count++
+		if count%exportFlushRows == 0 {
+			csvWriter.Flush()
+			controller.Flush()
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		// Leave the file truncated rather than pretending it is complete
+		log.Printf("Error reading products for export: %v", err)
+		return
+	}
+
+	if format == "csv" {
+		csvWriter.Flush()
+	} else {
+		w.Write([]byte("]\n"))
+	}
+}
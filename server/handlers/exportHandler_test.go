@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"ibuy-server/storage"
+	"testing"
+)
+
+func TestImageURL(t *testing.T) {
+	previousImages, previousURL := Images, PublicURL
+	defer func() { Images, PublicURL = previousImages, previousURL }()
+
+	tests := []struct {
+		store     storage.BlobStore
+		publicURL string
+		want      string
+	}{
+		{storage.NewDiskStore("."), "", "/uploads/products/u/p/1_a.jpg"},
+		{storage.NewDiskStore("."), "https://ibuy.example.com/", "https://ibuy.example.com/uploads/products/u/p/1_a.jpg"},
+		{storage.NewS3Store(storage.S3Config{Bucket: "images", PublicURL: "https://cdn.example.com"}), "https://ibuy.example.com",
+			"https://cdn.example.com/uploads/products/u/p/1_a.jpg"},
+	}
+	for _, tt := range tests {
+		Images, PublicURL = tt.store, tt.publicURL
+		if got := imageURL("uploads/products/u/p/1_a.jpg"); got != tt.want {
+			t.Errorf("imageURL with public URL %q = %q, want %q", tt.publicURL, got, tt.want)
+		}
+	}
+}
@@ -1,41 +1,40 @@
 package handlers
 
 import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"ibuy-server/imaging"
+	"ibuy-server/storage"
 	"io"
+	"log"
 	"net/http"
-	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"time"
 )
 
-func UploadImageHandler(r *http.Request, userId string, productId string) ([]string, error){
-	//Process images
-	form := r.MultipartForm
-    
-	if form == nil {
-		return []string{}, nil // No files uploaded, return empty slice
-	}
-	
-	files := form.File["images"]
+// Images holds the uploaded product images and their variants
+var Images storage.BlobStore = storage.NewDiskStore(".")
 
+// UploadImageHandler decodes and saves the validated uploads of a product one after the
+// other. When one of them fails the files already saved are removed again, so nothing is
+// left behind.
+func UploadImageHandler(uploads []ImageUpload, userId string, productId string) ([]string, error){
 	var savedFiles []string
 
-	for _, fileHeader := range files {
-
-		file, err := fileHeader.Open()
+	for _, upload := range uploads {
+		img, err := imaging.Decode(upload.Data)
 		if err != nil {
-            return nil, err
-        }
-		defer file.Close()
-
-		if !isValidImageType(fileHeader.Header.Get("Content-Type")) {
-           return nil, err
-        }
+			discardImageFiles(savedFiles)
+			return nil, &imageDecodeError{File: upload.Filename}
+		}
 
-		savedPath, err := saveImageFile(file, fileHeader.Filename, productId, userId)
+		savedPath, err := saveImageFile(img, upload.Filename, productId, userId)
         if err != nil {
+            discardImageFiles(savedFiles)
             return nil, err
         }
         
@@ -46,114 +45,135 @@ func UploadImageHandler(r *http.Request, userId string, productId string) ([]str
 }
 
 func DeleteImageFiles(imagePaths []string) error {
-    if len(imagePaths) == 0 {
-        return nil
-    }
-
-    // Track unique parent directories
-    parentDirs := make(map[string]bool)
-
-    // Delete each image file and collect parent directories
     for _, imagePath := range imagePaths {
         // Skip empty paths
         if strings.TrimSpace(imagePath) == "" {
             continue
         }
 
-        // Check if file exists before attempting to delete
-        if _, err := os.Stat(imagePath); os.IsNotExist(err) {
-            continue // Skip non-existent files
+        // The resized variants go together with their image, and before it so the
+        // disk store can clean up the folders they leave empty
+        for _, variant := range imaging.Variants {
+            variantPath := imageVariantPath(imagePath, variant)
+            if err := Images.Delete(variantPath); err != nil {
+                return fmt.Errorf("failed to delete file %s: %w", variantPath, err)
+            }
         }
 
-        // Delete the image file
-        if err := os.Remove(imagePath); err != nil {
+        if err := Images.Delete(filepath.ToSlash(imagePath)); err != nil {
             return fmt.Errorf("failed to delete file %s: %w", imagePath, err)
         }
-
-        // Get parent directory
-        parentDir := filepath.Dir(imagePath)
-        parentDirs[parentDir] = true
-    }
-
-    // Delete parent directories if they're empty
-    for parentDir := range parentDirs {
-        // Check if directory exists
-        if _, err := os.Stat(parentDir); os.IsNotExist(err) {
-            continue
-        }
-
-        // Check if directory is empty
-        entries, err := os.ReadDir(parentDir)
-        if err != nil {
-            return fmt.Errorf("failed to read directory %s: %w", parentDir, err)
-        }
-
-        // If directory is empty, delete it
-        if len(entries) == 0 {
-            if err := os.Remove(parentDir); err != nil {
-                return fmt.Errorf("failed to delete directory %s: %w", parentDir, err)
-            }
-        }
     }
 
     return nil
 }
 
-
-func isValidImageType(contentType string) bool {
-    validTypes := []string{
-        "image/jpeg",
-        "image/jpg", 
-        "image/png",
-        "image/gif",
-        "image/webp",
-    }
-    
-    for _, validType := range validTypes {
-        if contentType == validType {
-            return true
-        }
+// discardImageFiles is the compensating step for image files whose database change
+// did not go through, failures are only logged
+func discardImageFiles(imagePaths []string) {
+    if err := DeleteImageFiles(imagePaths); err != nil {
+        log.Printf("Error removing image files: %v", err)
     }
-    return false
 }
 
-func saveImageFile(file io.Reader, originalFilename, productId string, userId string) (string, error) {
-    // Create upload directory if it doesn't exist
-    uploadDir := filepath.Join("uploads", "products", userId, productId)
+// imageExtensions are the extensions images are stored with, by decoded format
+var imageExtensions = map[string]string{
+    "jpeg": ".jpg",
+    "png":  ".png",
+    "gif":  ".gif",
+}
 
-    if _, err := os.Stat(uploadDir); os.IsNotExist(err) {
-        err := os.MkdirAll(uploadDir, 0755)
-        if err != nil {
-            return "", err
+// saveImageFile stores a decoded image without its metadata and renders its variants next to it
+func saveImageFile(img *imaging.Image, originalFilename, productId string, userId string) (string, error) {
+    uploadDir := path.Join("uploads", "products", userId, productId)
+
+    // The extension, and with it the content type, follows the decoded image rather
+    // than the name the client sent
+    ext, ok := imageExtensions[img.Format]
+    if !ok {
+        return "", fmt.Errorf("unsupported image format: %s", img.Format)
     }
-}
 
-    // Generate unique filename to prevent conflicts
-    ext := filepath.Ext(originalFilename)
-    filename := fmt.Sprintf("%d_%s%s", time.Now().Unix(), 
-        strings.ReplaceAll(originalFilename[:len(originalFilename)-len(ext)], " ", "_"), 
+    // Generate unique filename to prevent conflicts. The random part keeps files with the
+    // same name saved within the same second apart.
+    unique := make([]byte, 8)
+    if _, err := rand.Read(unique); err != nil {
+        return "", err
+    }
+    name := strings.TrimSuffix(originalFilename, filepath.Ext(originalFilename))
+    filename := fmt.Sprintf("%d_%s_%s%s", time.Now().Unix(), hex.EncodeToString(unique),
+        strings.ReplaceAll(name, " ", "_"), 
         ext)
     
     // Create the full file path
-    filePath := filepath.Join(uploadDir, filename)
+    filePath := path.Join(uploadDir, filename)
+    contentType, err := GetMimeType(filePath)
+    if err != nil {
+        return "", err
+    }
     
-    // Create the destination file
-    dst, err := os.Create(filePath)
+    // Store the original, then the resized variants
+    original, err := img.Original()
     if err != nil {
         return "", err
     }
-    defer dst.Close()
+    if err := Images.Put(filePath, original, contentType); err != nil {
+        return "", err
+    }
 
-    // Copy the uploaded file to destination
-    _, err = io.Copy(dst, file)
-    if err != nil {
+    if err := writeImageVariants(img, filePath); err != nil {
+        discardImageFiles([]string{filePath})
         return "", err
     }
 
     return filePath, nil
 }
 
+// readImageFile loads a stored image or one of its variants
+func readImageFile(imagePath string) ([]byte, error) {
+    file, err := Images.Get(filepath.ToSlash(imagePath))
+    if err != nil {
+        return nil, err
+    }
+    defer file.Close()
+    return io.ReadAll(file)
+}
+
+// ServeImage sends a stored image from whichever store holds it. Stores with a
+// public URL of their own are redirected to.
+func ServeImage(w http.ResponseWriter, r *http.Request) {
+    key := strings.TrimPrefix(r.URL.Path, "/")
+
+    if url := Images.URL(key); !strings.HasPrefix(url, "/") {
+        http.Redirect(w, r, url, http.StatusFound)
+        return
+    }
+
+    contentType, err := GetMimeType(key)
+    if err != nil {
+        http.NotFound(w, r)
+        return
+    }
 
+    file, err := Images.Get(key)
+    if err != nil {
+        if errors.Is(err, storage.ErrNotFound) || errors.Is(err, storage.ErrInvalidKey) {
+            http.NotFound(w, r)
+            return
+        }
+        log.Printf("Error reading image %s: %v", key, err)
+        http.Error(w, "Failed to read image", http.StatusInternalServerError)
+        return
+    }
+    defer file.Close()
+
+    // Stored names are unique, so a key never changes its content
+    w.Header().Set("Content-Type", contentType)
+    w.Header().Set("Cache-Control", "private, max-age=31536000, immutable")
+    if _, err := io.Copy(w, file); err != nil {
+        log.Printf("Error sending image %s: %v", key, err)
+    }
+}
 
 func GetMimeType(filePath string) (string, error) {
     ext := strings.ToLower(filepath.Ext(filePath))
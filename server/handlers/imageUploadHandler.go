@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ibuy-server/imaging"
+	"image"
+	"io"
+	"net/http"
+)
+
+type ImageLimitConfig struct {
+	MaxFileSize    int64 // bytes per image
+	MaxListingSize int64 // bytes of all images uploaded for a listing in one request
+	MaxImages      int   // images per listing
+	MinDimension   int   // shortest side in pixels
+	MaxDimension   int   // longest side in pixels
+	MaxPixels      int   // width times height, decoding takes 4 bytes for each
+}
+
+// NewImageLimitConfig creates the default image upload limits
+func NewImageLimitConfig() *ImageLimitConfig {
+	return &ImageLimitConfig{
+		MaxFileSize:    10 << 20,
+		MaxListingSize: 40 << 20,
+		MaxImages:      10,
+		MinDimension:   100,
+		MaxDimension:   8000,
+		MaxPixels:      40_000_000,
+	}
+}
+
+var ImageLimits = NewImageLimitConfig()
+
+// allowedImageTypes are the content types, detected from the file itself, that can be processed
+var allowedImageTypes = map[string]bool{
+	"image/jpeg": true,
+	"image/png":  true,
+	"image/gif":  true,
+}
+
+// ImageError explains why one uploaded file was rejected
+type ImageError struct {
+	File  string `json:"file"`
+	Error string `json:"error"`
+}
+
+type ImageUploadError struct {
+	Error  string       `json:"error"`
+	Images []ImageError `json:"images"`
+}
+
+// ImageUpload is an uploaded file that passed validation. It is decoded only when it is
+// saved, one at a time, so a request never holds more than one decoded image.
+type ImageUpload struct {
+	Filename string
+	Data     []byte
+}
+
+// imageDecodeError is returned when an upload that passed validation cannot be decoded
+type imageDecodeError struct {
+	File string
+}
+
+func (e *imageDecodeError) Error() string {
+	return "image is damaged and cannot be decoded"
+}
+
+// validateImage checks an image by its content, not by its name or the type the client
+// claims. Only the header is read, so oversized images are rejected without allocating
+// memory for them.
+func validateImage(data []byte) error {
+	config, err := checkImageSize(data)
+	if err != nil {
+		return err
+	}
+	if min(config.Width, config.Height) < ImageLimits.MinDimension {
+		return fmt.Errorf("image is %dx%d pixels, its sides must be at least %d pixels", config.Width, config.Height, ImageLimits.MinDimension)
+	}
+	return nil
+}
+
+// checkImageSize checks what an image would cost to decode, from its header only
+func checkImageSize(data []byte) (image.Config, error) {
+	if len(data) == 0 {
+		return image.Config{}, fmt.Errorf("file is empty")
+	}
+	if int64(len(data)) > ImageLimits.MaxFileSize {
+		return image.Config{}, fmt.Errorf("file is larger than %d MB", ImageLimits.MaxFileSize>>20)
+	}
+
+	if contentType := http.DetectContentType(data); !allowedImageTypes[contentType] {
+		return image.Config{}, fmt.Errorf("file content is %s, only JPEG, PNG and GIF images are supported", contentType)
+	}
+
+	config, _, err := imaging.Inspect(data)
+	if err != nil {
+		return image.Config{}, fmt.Errorf("file is not a valid image")
+	}
+	if max(config.Width, config.Height) > ImageLimits.MaxDimension {
+		return image.Config{}, fmt.Errorf("image is %dx%d pixels, its sides may be at most %d pixels", config.Width, config.Height, ImageLimits.MaxDimension)
+	}
+	if config.Width*config.Height > ImageLimits.MaxPixels {
+		return image.Config{}, fmt.Errorf("image is %dx%d pixels, it may have at most %d megapixels", config.Width, config.Height, ImageLimits.MaxPixels/1_000_000)
+	}
+	return config, nil
+}
+
+// readImageUploads validates the files in the images field of a parsed multipart form
+// for a listing that keeps existing images. Limits of the listing as a whole fail the
+// upload, problems with single files are returned per file.
+func readImageUploads(r *http.Request, existing int) ([]ImageUpload, []ImageError, error) {
+	if r.MultipartForm == nil {
+		return nil, nil, nil
+	}
+	files := r.MultipartForm.File["images"]
+
+	if existing+len(files) > ImageLimits.MaxImages {
+		return nil, nil, fmt.Errorf("A listing can have at most %d images", ImageLimits.MaxImages)
+	}
+	var total int64
+	for _, fileHeader := range files {
+		total += fileHeader.Size
+	}
+	if total > ImageLimits.MaxListingSize {
+		return nil, nil, fmt.Errorf("Images of a listing may be at most %d MB together", ImageLimits.MaxListingSize>>20)
+	}
+
+	var uploads []ImageUpload
+	var problems []ImageError
+	for _, fileHeader := range files {
+		if fileHeader.Size > ImageLimits.MaxFileSize {
+			problems = append(problems, ImageError{File: fileHeader.Filename, Error: fmt.Sprintf("file is larger than %d MB", ImageLimits.MaxFileSize>>20)})
+			continue
+		}
+
+		file, err := fileHeader.Open()
+		if err != nil {
+			problems = append(problems, ImageError{File: fileHeader.Filename, Error: "file cannot be read"})
+			continue
+		}
+		data, err := io.ReadAll(io.LimitReader(file, ImageLimits.MaxFileSize+1))
+		file.Close()
+		if err != nil {
+			problems = append(problems, ImageError{File: fileHeader.Filename, Error: "file cannot be read"})
+			continue
+		}
+
+		if err := validateImage(data); err != nil {
+			problems = append(problems, ImageError{File: fileHeader.Filename, Error: err.Error()})
+			continue
+		}
+		uploads = append(uploads, ImageUpload{Filename: fileHeader.Filename, Data: data})
+	}
+	return uploads, problems, nil
+}
+
+// writeImageErrors responds with the reasons the uploaded images were rejected
+func writeImageErrors(w http.ResponseWriter, problems []ImageError) {
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(ImageUploadError{Error: "Some images were rejected", Images: problems})
+}
+
+// writeImageSaveError responds to a failed UploadImageHandler, an image that turned out
+// to be damaged is the client's problem
+func writeImageSaveError(w http.ResponseWriter, err error, message string) {
+	var damaged *imageDecodeError
+	if errors.As(err, &damaged) {
+		writeImageErrors(w, []ImageError{{File: damaged.File, Error: damaged.Error()}})
+		return
+	}
+	w.WriteHeader(http.StatusInternalServerError)
+	json.NewEncoder(w).Encode(map[string]string{"error": message})
+}
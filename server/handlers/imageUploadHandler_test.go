@@ -0,0 +1,126 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"ibuy-server/imaging"
+	"ibuy-server/storage"
+	"image"
+	"image/png"
+	"path"
+	"strings"
+	"testing"
+)
+
+// pngHeader is the start of a PNG claiming the given size, enough for the header checks
+func pngHeader(width, height int) []byte {
+	ihdr := []byte("IHDR")
+	ihdr = binary.BigEndian.AppendUint32(ihdr, uint32(width))
+	ihdr = binary.BigEndian.AppendUint32(ihdr, uint32(height))
+	ihdr = append(ihdr, 8, 6, 0, 0, 0) // 8 bit RGBA
+
+	data := []byte("\x89PNG\r\n\x1a\n")
+	data = binary.BigEndian.AppendUint32(data, uint32(len(ihdr)-4))
+	data = append(data, ihdr...)
+	return binary.BigEndian.AppendUint32(data, crc32.ChecksumIEEE(ihdr))
+}
+
+func encodeTestPNG(t *testing.T, width, height int) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, width, height))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestValidateImageLimits(t *testing.T) {
+	tests := []struct {
+		width, height int
+		err           string
+	}{
+		{1200, 800, ""},
+		{8000, 5000, ""},
+		{8000, 8000, "megapixels"},
+		{8001, 200, "at most 8000 pixels"},
+		{99, 500, "at least 100 pixels"},
+	}
+	for _, tt := range tests {
+		err := validateImage(pngHeader(tt.width, tt.height))
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%dx%d rejected: %v", tt.width, tt.height, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%dx%d: error %v, want one mentioning %q", tt.width, tt.height, err, tt.err)
+		}
+	}
+}
+
+func TestUploadImageHandlerRejectsDamagedImage(t *testing.T) {
+	uploads := []ImageUpload{{Filename: "broken.png", Data: pngHeader(1200, 800)}}
+	_, err := UploadImageHandler(uploads, "user", "product")
+	damaged, ok := err.(*imageDecodeError)
+	if !ok || damaged.File != "broken.png" {
+		t.Errorf("UploadImageHandler = %v, want an imageDecodeError for broken.png", err)
+	}
+}
+
+func TestSaveImageFileNamesByContent(t *testing.T) {
+	previous := Images
+	Images = storage.NewDiskStore(t.TempDir())
+	defer func() { Images = previous }()
+
+	img, err := imaging.Decode(encodeTestPNG(t, 120, 120))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A PNG sent with a JPEG name, and a name without any extension
+	for _, filename := range []string{"holiday photo.jpg", "scan"} {
+		savedPath, err := saveImageFile(img, filename, "product", "user")
+		if err != nil {
+			t.Fatalf("saveImageFile(%q): %v", filename, err)
+		}
+		if !strings.HasSuffix(savedPath, ".png") || strings.Contains(savedPath, ".jpg") || strings.Contains(savedPath, " ") {
+			t.Errorf("saveImageFile(%q) stored %s, want a .png name", filename, savedPath)
+		}
+		if contentType, _ := GetMimeType(savedPath); contentType != "image/png" {
+			t.Errorf("%s is served as %s, want image/png", savedPath, contentType)
+		}
+		if exists, err := Images.Exists(imageVariantPath(savedPath, imaging.Thumbnail)); err != nil || !exists {
+			t.Errorf("thumbnail of %s missing: %v", savedPath, err)
+		}
+	}
+}
+
+func TestSaveImageFileKeepsSameNamesApart(t *testing.T) {
+	previous := Images
+	Images = storage.NewDiskStore(t.TempDir())
+	defer func() { Images = previous }()
+
+	img, err := imaging.Decode(encodeTestPNG(t, 120, 120))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Copies and imports of photo.png from different places, saved within the same second
+	first, err := saveImageFile(img, "photo.png", "product", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := saveImageFile(img, "photo.png", "product", "user")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if first == second {
+		t.Fatalf("both images stored as %s", first)
+	}
+
+	// Duplicating keeps the name the client gave, without the stored prefix
+	for _, stored := range []string{first, "uploads/products/user/product/1700000000_photo.png"} {
+		if name := storedNamePrefix.ReplaceAllString(path.Base(stored), ""); name != "photo.png" {
+			t.Errorf("name of %s = %q, want photo.png", stored, name)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"ibuy-server/db"
+	"ibuy-server/imaging"
+	"io"
+	"log"
+	"path"
+	"path/filepath"
+)
+
+// ImageVariants are the URL paths of the sizes rendered for an uploaded image
+type ImageVariants struct {
+	Original  string `json:"original"`
+	Full      string `json:"full"`
+	Card      string `json:"card"`
+	Thumbnail string `json:"thumbnail"`
+}
+
+// imageVariantPath is where a variant of a stored image lives, in a folder per variant
+// next to the original. The original name is kept whole so variants never collide.
+func imageVariantPath(imagePath string, variant imaging.Variant) string {
+	imagePath = filepath.ToSlash(imagePath)
+	return path.Join(path.Dir(imagePath), variant.Name, path.Base(imagePath)+".jpg")
+}
+
+// setImageVariants fills in the variants of the product's images, in the same order
+func (p *ProductResponse) setImageVariants() {
+	p.ImageVariants = make([]ImageVariants, 0, len(p.Images))
+	for _, imagePath := range p.Images {
+		p.ImageVariants = append(p.ImageVariants, ImageVariants{
+			Original:  imagePath,
+			Full:      imageVariantPath(imagePath, imaging.Full),
+			Card:      imageVariantPath(imagePath, imaging.Card),
+			Thumbnail: imageVariantPath(imagePath, imaging.Thumbnail),
+		})
+	}
+}
+
+// writeImageVariants renders every variant of an image stored at imagePath. Nothing is
+// left behind when one of them fails.
+func writeImageVariants(img *imaging.Image, imagePath string) error {
+	var written []string
+	for _, variant := range imaging.Variants {
+		variantPath := imageVariantPath(imagePath, variant)
+
+		var buf bytes.Buffer
+		if err := img.Render(&buf, variant); err != nil {
+			discardImageFiles(written)
+			return err
+		}
+		if err := Images.Put(variantPath, buf.Bytes(), "image/jpeg"); err != nil {
+			discardImageFiles(written)
+			return err
+		}
+		written = append(written, variantPath)
+	}
+	return nil
+}
+
+// imageBackfillLock is the advisory lock held by the replica running the backfill
+const imageBackfillLock = 0x1b0f11
+
+// RunImageVariantBackfill renders the variants of images uploaded before they existed.
+// Every replica starts it, the first one to take the lock does the work.
+func RunImageVariantBackfill() {
+	ctx := context.Background()
+	conn, err := db.DB.Conn(ctx)
+	if err != nil {
+		log.Printf("Error starting image variant backfill: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	var locked bool
+	if err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock($1)", imageBackfillLock).Scan(&locked); err != nil {
+		log.Printf("Error starting image variant backfill: %v", err)
+		return
+	}
+	if !locked {
+		return
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", imageBackfillLock)
+
+	rows, err := conn.QueryContext(ctx, "SELECT image_path FROM product_image")
+	if err != nil {
+		log.Printf("Error querying images for variants: %v", err)
+		return
+	}
+
+	var imagePaths []string
+	for rows.Next() {
+		var imagePath string
+		if err := rows.Scan(&imagePath); err == nil {
+			imagePaths = append(imagePaths, imagePath)
+		}
+	}
+	rows.Close()
+
+	rendered := 0
+	for _, imagePath := range imagePaths {
+		// Variants are written smallest first and removed again when one fails,
+		// so a thumbnail means the image is done
+		done, err := Images.Exists(imageVariantPath(imagePath, imaging.Thumbnail))
+		if err != nil {
+			log.Printf("Error checking variants of %s: %v", imagePath, err)
+			continue
+		}
+		if done {
+			continue
+		}
+
+		data, err := readLegacyImage(imagePath)
+		if err != nil {
+			log.Printf("Error reading image %s: %v", imagePath, err)
+			continue
+		}
+		// Older uploads were not checked like new ones, so they pass the same limits
+		// before anything is decoded
+		if _, err := checkImageSize(data); err != nil {
+			log.Printf("Skipping variants of %s: %v", imagePath, err)
+			continue
+		}
+		img, err := imaging.Decode(data)
+		if err != nil {
+			log.Printf("Error decoding image %s: %v", imagePath, err)
+			continue
+		}
+		if err := writeImageVariants(img, imagePath); err != nil {
+			log.Printf("Error rendering variants of %s: %v", imagePath, err)
+			continue
+		}
+		rendered++
+	}
+
+	if rendered > 0 {
+		log.Printf("Rendered variants for %d images", rendered)
+	}
+}
+
+// readLegacyImage reads a stored original, one past the upload size limit at most
+func readLegacyImage(imagePath string) ([]byte, error) {
+	file, err := Images.Get(filepath.ToSlash(imagePath))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(io.LimitReader(file, ImageLimits.MaxFileSize+1))
+}
@@ -0,0 +1,510 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ibuy-server/db"
+	"ibuy-server/netguard"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Import job statuses
+const (
+	ImportPending = "pending"
+	ImportRunning = "running"
+	ImportDone    = "done"
+	ImportFailed  = "failed"
+)
+
+const maxImportRows = 1000
+
+const (
+	// importProgressInterval is how often a running import saves its report at the latest,
+	// which also shows it is still alive
+	importProgressInterval = 30 * time.Second
+	// importStaleAfter is how long an unfinished import may go without progress before it
+	// is considered lost, e.g. to a restart. A single row takes far less.
+	importStaleAfter = 10 * time.Minute
+)
+
+var importColumns = []string{"name", "description", "price", "category", "condition", "location", "images"}
+
+// imageClient downloads images referenced by URL in imports. The URLs come from sellers,
+// so only public https addresses are reached, after redirects too.
+var imageClient = netguard.NewClient(20 * time.Second)
+
+type ImportRowResult struct {
+	Row       int    `json:"row"`
+	ProductID string `json:"productId,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+type ImportJob struct {
+	JobID     string            `json:"jobId"`
+	Status    string            `json:"status"`
+	Total     int               `json:"total"`
+	Succeeded int               `json:"succeeded"`
+	Failed    int               `json:"failed"`
+	Results   []ImportRowResult `json:"results"`
+	Error     string            `json:"error,omitempty"`
+	Created   time.Time         `json:"created"`
+	Finished  *time.Time        `json:"finished,omitempty"`
+}
+
+// ImportProducts accepts a CSV file of listings, and optionally a ZIP file with the images
+// it references, and creates the listings in the background. The response points to the
+// job, whose report lists the result of every row.
+//
+// Columns: name, description, price, category (id or name), condition, location and images,
+// a ";" separated list of image URLs or file names inside the ZIP.
+func ImportProducts(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	err := r.ParseMultipartForm(32 << 20) // 32MB max
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+
+	csvData, err := readFormFile(r, "file")
+	if err != nil || csvData == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "A CSV file is required"})
+		return
+	}
+	zipData, err := readFormFile(r, "images")
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid images archive"})
+		return
+	}
+
+	// Reject files that cannot be read at all right away, row problems end up in the report
+	rows, err := parseImportCSV(csvData)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+	var archive *zip.Reader
+	if zipData != nil {
+		archive, err = zip.NewReader(bytes.NewReader(zipData), int64(len(zipData)))
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid images archive"})
+			return
+		}
+	}
+
+	job := ImportJob{Status: ImportPending, Total: len(rows), Results: []ImportRowResult{}}
+	err = db.DB.QueryRow(
+		"INSERT INTO import_job (u_id, total) VALUES ($1, $2) RETURNING j_id, created",
+		userContext.UserId, len(rows),
+	).Scan(&job.JobID, &job.Created)
+	if err != nil {
+		log.Printf("Error creating import job: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to start import"})
+		return
+	}
+
+	go runImport(job.JobID, userContext.UserId, rows, archive)
+
+	w.WriteHeader(http.StatusAccepted)
+
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+// GetImportJob returns the progress and per-row report of an import
+func GetImportJob(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	var job ImportJob
+	var results []byte
+	var jobError sql.NullString
+	var finished sql.NullTime
+	err := db.DB.QueryRow(
+		"SELECT j_id, status, total, succeeded, failed, results, error, created, finished FROM import_job WHERE j_id = $1 AND u_id = $2",
+		r.PathValue("id"), userContext.UserId,
+	).Scan(&job.JobID, &job.Status, &job.Total, &job.Succeeded, &job.Failed, &results, &jobError, &job.Created, &finished)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Import not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get import"})
+		return
+	}
+
+	if err := json.Unmarshal(results, &job.Results); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read import results"})
+		return
+	}
+	job.Error = jobError.String
+	job.Finished = nullTimePtr(finished)
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(job); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+// readFormFile returns the content of an uploaded file, or nil when it was not sent
+func readFormFile(r *http.Request, field string) ([]byte, error) {
+	file, _, err := r.FormFile(field)
+	if err == http.ErrMissingFile {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return io.ReadAll(file)
+}
+
+// parseImportCSV reads the CSV into maps of column name to value, one per data row
+func parseImportCSV(data []byte) ([]map[string]string, error) {
+	reader := csv.NewReader(bytes.NewReader(data))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV file: %v", err)
+	}
+
+	columns := make([]string, len(header))
+	for i, column := range header {
+		columns[i] = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(column, "\ufeff")))
+	}
+	for _, required := range []string{"name", "price", "category"} {
+		if !slices.Contains(columns, required) {
+			return nil, fmt.Errorf("CSV file is missing the %s column, expected columns: %s", required, strings.Join(importColumns, ", "))
+		}
+	}
+
+	var rows []map[string]string
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid CSV file: %v", err)
+		}
+
+		row := map[string]string{}
+		for i, value := range record {
+			if i < len(columns) {
+				row[columns[i]] = strings.TrimSpace(value)
+			}
+		}
+		rows = append(rows, row)
+		if len(rows) > maxImportRows {
+			return nil, fmt.Errorf("CSV file has more than %d rows", maxImportRows)
+		}
+	}
+
+	if len(rows) == 0 {
+		return nil, fmt.Errorf("CSV file has no rows")
+	}
+	return rows, nil
+}
+
+func runImport(jobId, userId string, rows []map[string]string, archive *zip.Reader) {
+	// A crash in one import must neither take the server down nor leave the job running forever
+	defer func() {
+		if p := recover(); p != nil {
+			log.Printf("Import %s panicked: %v", jobId, p)
+			failImport(jobId, "Import stopped unexpectedly")
+		}
+	}()
+
+	if _, err := db.DB.Exec("UPDATE import_job SET status = $1, updated = $2 WHERE j_id = $3", ImportRunning, time.Now(), jobId); err != nil {
+		log.Printf("Error starting import %s: %v", jobId, err)
+	}
+
+	categories, err := loadCategoryIds()
+	if err != nil {
+		log.Printf("Error loading categories for import %s: %v", jobId, err)
+		failImport(jobId, "Failed to load categories")
+		return
+	}
+
+	results := make([]ImportRowResult, 0, len(rows))
+	succeeded, failed := 0, 0
+	lastSaved := time.Now()
+	for i, row := range rows {
+		// Row numbers match the spreadsheet, the header is row 1
+		result := ImportRowResult{Row: i + 2}
+		productId, err := importRow(userId, row, categories, archive)
+		if err != nil {
+			result.Error = err.Error()
+			failed++
+		} else {
+			result.ProductID = productId
+			succeeded++
+		}
+		results = append(results, result)
+
+		// Keep the report current so progress can be followed
+		if (i+1)%25 == 0 || time.Since(lastSaved) >= importProgressInterval {
+			saveImportProgress(jobId, ImportRunning, succeeded, failed, results)
+			lastSaved = time.Now()
+		}
+	}
+
+	saveImportProgress(jobId, ImportDone, succeeded, failed, results)
+	log.Printf("Import %s finished: %d created, %d failed", jobId, succeeded, failed)
+}
+
+func saveImportProgress(jobId, status string, succeeded, failed int, results []ImportRowResult) {
+	data, err := json.Marshal(results)
+	if err != nil {
+		log.Printf("Error encoding import results: %v", err)
+		return
+	}
+
+	var finished *time.Time
+	if status == ImportDone {
+		now := time.Now()
+		finished = &now
+	}
+
+	_, err = db.DB.Exec(
+		"UPDATE import_job SET status = $1, succeeded = $2, failed = $3, results = $4::jsonb, finished = $5, updated = $6 WHERE j_id = $7",
+		status, succeeded, failed, string(data), finished, time.Now(), jobId,
+	)
+	if err != nil {
+		log.Printf("Error saving import progress of %s: %v", jobId, err)
+	}
+}
+
+func failImport(jobId, message string) {
+	now := time.Now()
+	_, err := db.DB.Exec(
+		"UPDATE import_job SET status = $1, error = $2, finished = $3, updated = $3 WHERE j_id = $4",
+		ImportFailed, message, now, jobId,
+	)
+	if err != nil {
+		log.Printf("Error failing import %s: %v", jobId, err)
+	}
+}
+
+// RunImportWatchdog marks imports failed that stopped making progress, e.g. because the
+// server running them was restarted. It checks right away and then periodically, as other
+// replicas may lose their imports at any time.
+func RunImportWatchdog() {
+	ticker := time.NewTicker(importStaleAfter / 2)
+	defer ticker.Stop()
+
+	for {
+		failStaleImports()
+		<-ticker.C
+	}
+}
+
+func failStaleImports() {
+	now := time.Now()
+	result, err := db.DB.Exec(
+		"UPDATE import_job SET status = $1, error = $2, finished = $3, updated = $3 WHERE status IN ($4, $5) AND updated < $6",
+		ImportFailed, "Import was interrupted, please upload the file again", now, ImportPending, ImportRunning, now.Add(-importStaleAfter),
+	)
+	if err != nil {
+		log.Printf("Error failing stale imports: %v", err)
+		return
+	}
+	if count, err := result.RowsAffected(); err == nil && count > 0 {
+		log.Printf("Marked %d interrupted imports as failed", count)
+	}
+}
+
+// loadCategoryIds maps lower case category names and ids to category ids
+func loadCategoryIds() (map[string]int, error) {
+	rows, err := db.DB.Query("SELECT id, name FROM category")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	categories := map[string]int{}
+	for rows.Next() {
+		var id int
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		categories[strings.ToLower(name)] = id
+		categories[strconv.Itoa(id)] = id
+	}
+	return categories, rows.Err()
+}
+
+// importRow validates a row and creates an active listing with its images
+func importRow(userId string, row map[string]string, categories map[string]int, archive *zip.Reader) (string, error) {
+	newProduct := NewProduct{
+		Name:           row["name"],
+		Description:    row["description"],
+		Condition:      row["condition"],
+		Location:       row["location"],
+		ShippingOption: ShippingPickup,
+	}
+	if newProduct.Name == "" {
+		return "", fmt.Errorf("name is required")
+	}
+
+	price, err := strconv.ParseFloat(row["price"], 32)
+	if err != nil || price < 0 {
+		return "", fmt.Errorf("invalid price %q", row["price"])
+	}
+	newProduct.Price = float32(price)
+
+	category, ok := categories[strings.ToLower(row["category"])]
+	if !ok {
+		return "", fmt.Errorf("unknown category %q", row["category"])
+	}
+	newProduct.Category = category
+
+	// Fetch and validate the images first so a row with a broken image does not leave a listing behind
+	var refs []string
+	for _, ref := range strings.Split(row["images"], ";") {
+		if ref = strings.TrimSpace(ref); ref != "" {
+			refs = append(refs, ref)
+		}
+	}
+	if len(refs) > ImageLimits.MaxImages {
+		return "", fmt.Errorf("a listing can have at most %d images", ImageLimits.MaxImages)
+	}
+
+	var uploads []ImageUpload
+	for _, ref := range refs {
+		image, err := fetchImportImage(ref, archive)
+		if err != nil {
+			return "", fmt.Errorf("image %s: %v", ref, err)
+		}
+		if err := validateImage(image.data); err != nil {
+			return "", fmt.Errorf("image %s: %v", ref, err)
+		}
+		uploads = append(uploads, ImageUpload{Filename: image.name, Data: image.data})
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return "", fmt.Errorf("failed to create product")
+	}
+	defer tx.Rollback()
+
+	product, err := insertProduct(tx, userId, newProduct, StatusActive)
+	if err != nil {
+		return "", fmt.Errorf("failed to create product")
+	}
+
+	imagePaths, err := UploadImageHandler(uploads, userId, product.ProductID)
+	if err != nil {
+		var damaged *imageDecodeError
+		if errors.As(err, &damaged) {
+			return "", fmt.Errorf("image %s: %v", damaged.File, damaged)
+		}
+		return "", fmt.Errorf("failed to save images")
+	}
+	for _, imagePath := range imagePaths {
+		product.Images = append(product.Images, strings.ReplaceAll(imagePath, "\\", "/"))
+	}
+
+	err = addProductImages(tx, product.ProductID, product.Images)
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		discardImageFiles(product.Images)
+		return "", fmt.Errorf("failed to create product")
+	}
+
+	go matchSavedSearches(product)
+	return product.ProductID, nil
+}
+
+type importedImage struct {
+	name string
+	data []byte
+}
+
+// fetchImportImage downloads an image URL or reads a file from the uploaded archive
+func fetchImportImage(ref string, archive *zip.Reader) (importedImage, error) {
+	if strings.HasPrefix(ref, "http://") || strings.HasPrefix(ref, "https://") {
+		if err := netguard.CheckURL(ref); err != nil {
+			return importedImage{}, fmt.Errorf("only public https image URLs are supported")
+		}
+		resp, err := imageClient.Get(ref)
+		if err != nil {
+			return importedImage{}, fmt.Errorf("download failed")
+		}
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			return importedImage{}, fmt.Errorf("download failed with %s", resp.Status)
+		}
+		// The content type is checked on the data itself by validateImage
+		data, err := io.ReadAll(io.LimitReader(resp.Body, ImageLimits.MaxFileSize+1))
+		if err != nil {
+			return importedImage{}, fmt.Errorf("download failed")
+		}
+		return importedImage{name: path.Base(resp.Request.URL.Path), data: data}, nil
+	}
+
+	if archive == nil {
+		return importedImage{}, fmt.Errorf("not a URL and no images archive was uploaded")
+	}
+	for _, file := range archive.File {
+		if file.Name != ref && path.Base(file.Name) != ref {
+			continue
+		}
+		if file.UncompressedSize64 > uint64(ImageLimits.MaxFileSize) {
+			return importedImage{}, fmt.Errorf("file is larger than %d MB", ImageLimits.MaxFileSize>>20)
+		}
+		rc, err := file.Open()
+		if err != nil {
+			return importedImage{}, fmt.Errorf("cannot be read from the archive")
+		}
+		defer rc.Close()
+		data, err := io.ReadAll(io.LimitReader(rc, ImageLimits.MaxFileSize+1))
+		if err != nil {
+			return importedImage{}, fmt.Errorf("cannot be read from the archive")
+		}
+		return importedImage{name: path.Base(file.Name), data: data}, nil
+	}
+	return importedImage{}, fmt.Errorf("not found in the images archive")
+}
@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"ibuy-server/db"
+	"ibuy-server/websocket"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Notification types
+const (
+	NotificationPriceDrop    = "price_drop"
+	NotificationStatusChange = "status_change"
+	NotificationMessage      = "message"
+	NotificationOffer        = "offer"
+	NotificationSold         = "sold"
+	NotificationReview       = "review"
+)
+
+const (
+	defaultNotificationLimit = 20
+	maxNotificationLimit     = 100
+)
+
+type Notification struct {
+	NotificationID string    `json:"notificationId"`
+	Type           string    `json:"type"`
+	Content        string    `json:"content"`
+	ProductID      string    `json:"productId"`
+	Seen           bool      `json:"seen"`
+	Created        time.Time `json:"created"`
+}
+
+// notificationTitles are the headlines of notifications shown outside the app
+var notificationTitles = map[string]string{
+	NotificationPriceDrop:      "Price drop",
+	NotificationStatusChange:   "Listing update",
+	NotificationMessage:        "New message",
+	NotificationOffer:          "Offer update",
+	NotificationSold:           "Sold",
+	NotificationReview:         "New review",
+	NotificationSavedSearch:    "New listing for your saved search",
+	NotificationListingExpired: "Listing expired",
+}
+
+// notify delivers a notification on the channels the user enabled for its type: it is
+// stored for the notification center and pushed over the websocket when they are
+// connected, or sent as a web push when they are not.
+func notify(userId, notificationType, content, productId string) error {
+	notification := Notification{
+		Type:      notificationType,
+		Content:   content,
+		ProductID: productId,
+		Created:   time.Now(),
+	}
+
+	if notificationEnabled(userId, notificationType, ChannelInApp) {
+		err := db.DB.QueryRow(
+			"INSERT INTO notification (u_id, type, content, product_id) VALUES ($1, $2, $3, NULLIF($4, '')::uuid) RETURNING n_id, created",
+			userId, notificationType, content, productId,
+		).Scan(&notification.NotificationID, &notification.Created)
+		if err != nil {
+			return err
+		}
+	}
+
+	if !ChatHub.IsOnline(userId) {
+		sendPush(userId, PushPayload{
+			Type:      notificationType,
+			Title:     notificationTitles[notificationType],
+			Body:      content,
+			ProductID: productId,
+		})
+		return nil
+	}
+
+	if notificationEnabled(userId, notificationType, ChannelWebsocket) {
+		ChatHub.RegisterNotification(websocket.Notification{
+			Receiver: userId,
+			Data:     notification,
+		})
+	}
+	return nil
+}
+
+// notifyAsync sends a notification in the background, logging failures
+func notifyAsync(userId, notificationType, content, productId string) {
+	go func() {
+		if err := notify(userId, notificationType, content, productId); err != nil {
+			log.Printf("Error sending %s notification to %s: %v", notificationType, userId, err)
+		}
+	}()
+}
+
+// notifyWatchers notifies every user watching a product
+func notifyWatchers(productId, notificationType, content string) {
+	rows, err := db.DB.Query("SELECT u_id FROM watchlist WHERE product_id = $1", productId)
+	if err != nil {
+		log.Printf("Error querying watchers of %s: %v", productId, err)
+		return
+	}
+
+	var watchers []string
+	for rows.Next() {
+		var userId string
+		if err := rows.Scan(&userId); err == nil {
+			watchers = append(watchers, userId)
+		}
+	}
+	rows.Close()
+
+	for _, userId := range watchers {
+		if err := notify(userId, notificationType, content, productId); err != nil {
+			log.Printf("Error notifying watcher %s: %v", userId, err)
+		}
+	}
+}
+
+type NotificationPage struct {
+	Notifications []Notification `json:"notifications"`
+	Unread        int            `json:"unread"`
+}
+
+// GetNotifications returns the current user's notifications, newest first.
+// Pass unread=true to only get the ones not seen yet.
+func GetNotifications(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	limit := defaultNotificationLimit
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = min(l, maxNotificationLimit)
+	}
+	offset := 0
+	if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && o > 0 {
+		offset = o
+	}
+	unreadOnly := r.URL.Query().Get("unread") == "true"
+
+	rows, err := db.DB.Query(`
+		SELECT n_id, type, content, product_id, seen, created
+		FROM notification
+		WHERE u_id = $1 AND (NOT $2 OR NOT seen)
+		ORDER BY created DESC
+		LIMIT $3 OFFSET $4`,
+		userContext.UserId, unreadOnly, limit, offset,
+	)
+	if err != nil {
+		log.Printf("Error querying notifications: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get notifications"})
+		return
+	}
+	defer rows.Close()
+
+	page := NotificationPage{Notifications: []Notification{}}
+	for rows.Next() {
+		var notification Notification
+		var productId sql.NullString
+		err := rows.Scan(
+			&notification.NotificationID,
+			&notification.Type,
+			&notification.Content,
+			&productId,
+			&notification.Seen,
+			&notification.Created,
+		)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get all notification info"})
+			return
+		}
+		notification.ProductID = productId.String
+		page.Notifications = append(page.Notifications, notification)
+	}
+
+	if err = rows.Err(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read notifications"})
+		return
+	}
+
+	err = db.DB.QueryRow("SELECT COUNT(*) FROM notification WHERE u_id = $1 AND NOT seen", userContext.UserId).Scan(&page.Unread)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to count unread notifications"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+func MarkNotificationRead(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	notificationId := r.PathValue("id")
+	if notificationId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid notification URL"})
+		return
+	}
+
+	result, err := db.DB.Exec("UPDATE notification SET seen = TRUE WHERE n_id = $1 AND u_id = $2", notificationId, userContext.UserId)
+	if err != nil {
+		log.Printf("Error marking notification as read: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to mark notification as read"})
+		return
+	}
+
+	if count, _ := result.RowsAffected(); count == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Notification not found"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Notification marked as read"})
+}
+
+func MarkAllNotificationsRead(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	_, err := db.DB.Exec("UPDATE notification SET seen = TRUE WHERE u_id = $1 AND NOT seen", userContext.UserId)
+	if err != nil {
+		log.Printf("Error marking notifications as read: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to mark notifications as read"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Notifications marked as read"})
+}
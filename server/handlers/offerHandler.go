@@ -0,0 +1,448 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"ibuy-server/db"
+	"ibuy-server/websocket"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Offer status ids as seeded in db/tables.sql
+const (
+	OfferPending   = 1
+	OfferAccepted  = 2
+	OfferDeclined  = 3
+	OfferCountered = 4
+	OfferExpired   = 5
+)
+
+const (
+	defaultOfferExpiry = 48 * time.Hour
+	maxOfferExpiry     = 7 * 24 * time.Hour
+)
+
+// OfferConfig holds configuration for expiring offers
+type OfferConfig struct {
+	CheckInterval time.Duration // how often the expirer looks for offers past their expiry
+}
+
+// NewOfferConfig creates a default offer configuration
+func NewOfferConfig() *OfferConfig {
+	return &OfferConfig{
+		CheckInterval: time.Minute,
+	}
+}
+
+var Offers = NewOfferConfig()
+
+type NewOffer struct {
+	Amount         float32 `json:"amount"`
+	ExpiresInHours int     `json:"expiresInHours"`
+}
+
+type Offer struct {
+	OfferID     string     `json:"offerId"`
+	ProductID   string     `json:"productId"`
+	Buyer       string     `json:"buyer"`
+	Seller      string     `json:"seller"`
+	Sender      string     `json:"sender"`
+	Amount      float32    `json:"amount"`
+	Status      int        `json:"status"`
+	ParentID    string     `json:"parentId"`
+	Created     time.Time  `json:"created"`
+	ExpiresAt   time.Time  `json:"expiresAt"`
+	RespondedAt *time.Time `json:"respondedAt"`
+}
+
+// offerExpiry turns the requested lifetime of an offer into its expiry time.
+func offerExpiry(hours int) time.Time {
+	expiry := time.Duration(hours) * time.Hour
+	if expiry <= 0 {
+		expiry = defaultOfferExpiry
+	}
+	if expiry > maxOfferExpiry {
+		expiry = maxOfferExpiry
+	}
+	return time.Now().Add(expiry)
+}
+
+// RunOfferExpirer periodically marks pending offers past their expiry as expired.
+// Until it runs, readers treat such offers as expired themselves.
+func RunOfferExpirer(config *OfferConfig) {
+	ticker := time.NewTicker(config.CheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := expireStaleOffers(); err != nil {
+			log.Printf("Error expiring offers: %v", err)
+		}
+	}
+}
+
+// expireStaleOffers marks pending offers past their expiry as expired.
+func expireStaleOffers() error {
+	_, err := db.DB.Exec(
+		"UPDATE offer SET status_id = $1 WHERE status_id = $2 AND expires_at < $3",
+		OfferExpired, OfferPending, time.Now(),
+	)
+	return err
+}
+
+// insertOfferMessage stores an offer event in the conversation so it shows up inline in GetMessages.
+func insertOfferMessage(tx *sql.Tx, offer Offer, sender string, content string) error {
+	receiver := offer.Seller
+	if sender == offer.Seller {
+		receiver = offer.Buyer
+	}
+
+	_, err := tx.Exec(
+		"INSERT INTO message (content, sender, receiver, product_id, created, seen, type, offer_id) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)",
+		content, sender, receiver, offer.ProductID, time.Now(), false, "offer", offer.OfferID,
+	)
+	return err
+}
+
+// pushOfferEvent notifies the other party of an offer event over the websocket hub
+// and in their notification center.
+func pushOfferEvent(offer Offer, sender string, content string) {
+	receiver := offer.Seller
+	if sender == offer.Seller {
+		receiver = offer.Buyer
+	}
+
+	ChatHub.RegisterMessage(websocket.Message{
+		Type:      "offer",
+		Content:   content,
+		Sender:    sender,
+		Receiver:  receiver,
+		ProductId: offer.ProductID,
+		OfferId:   offer.OfferID,
+		Silent:    !notificationEnabled(receiver, NotificationOffer, ChannelWebsocket),
+	})
+	notifyAsync(receiver, NotificationOffer, content, offer.ProductID)
+}
+
+func MakeOffer(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+	var userId = userContext.UserId
+
+	productId := r.PathValue("id")
+	if productId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid product URL"})
+		return
+	}
+
+	var newOffer NewOffer
+	if err := json.NewDecoder(r.Body).Decode(&newOffer); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	defer r.Body.Close()
+
+	if newOffer.Amount <= 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid amount value"})
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create offer"})
+		return
+	}
+	defer tx.Rollback()
+
+	var sellerId string
+	var statusId int
+	err = tx.QueryRow("SELECT u_id, status_id FROM product WHERE p_id = $1 AND deleted_at IS NULL", productId).Scan(&sellerId, &statusId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create offer"})
+		return
+	}
+
+	if sellerId == userId {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You cannot make an offer on your own product"})
+		return
+	}
+
+	if statusId != StatusActive {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Product is not available"})
+		return
+	}
+
+	var hasPending bool
+	err = tx.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM offer WHERE product_id = $1 AND buyer = $2 AND status_id = $3 AND expires_at >= $4)",
+		productId, userId, OfferPending, time.Now(),
+	).Scan(&hasPending)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create offer"})
+		return
+	}
+	if hasPending {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You already have a pending offer on this product"})
+		return
+	}
+
+	offer := Offer{
+		ProductID: productId,
+		Buyer:     userId,
+		Seller:    sellerId,
+		Sender:    userId,
+		Amount:    newOffer.Amount,
+		Status:    OfferPending,
+		ExpiresAt: offerExpiry(newOffer.ExpiresInHours),
+	}
+
+	err = tx.QueryRow(
+		"INSERT INTO offer (product_id, buyer, seller, sender, amount, status_id, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING o_id, created",
+		offer.ProductID, offer.Buyer, offer.Seller, offer.Sender, offer.Amount, offer.Status, offer.ExpiresAt,
+	).Scan(&offer.OfferID, &offer.Created)
+	if err != nil {
+		log.Printf("Error saving offer: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create offer"})
+		return
+	}
+
+	content := fmt.Sprintf("Offered %.2f", offer.Amount)
+	if err := insertOfferMessage(tx, offer, userId, content); err != nil {
+		log.Printf("Error saving offer message: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create offer"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create offer"})
+		return
+	}
+
+	pushOfferEvent(offer, userId, content)
+
+	w.WriteHeader(http.StatusCreated)
+
+	if err := json.NewEncoder(w).Encode(offer); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+func AcceptOffer(w http.ResponseWriter, r *http.Request) {
+	respondToOffer(w, r, OfferAccepted)
+}
+
+func DeclineOffer(w http.ResponseWriter, r *http.Request) {
+	respondToOffer(w, r, OfferDeclined)
+}
+
+func CounterOffer(w http.ResponseWriter, r *http.Request) {
+	respondToOffer(w, r, OfferCountered)
+}
+
+// respondToOffer resolves a pending offer. Only the party the offer was sent to may respond.
+// Accepting reserves the product for the buyer, countering creates a new pending offer
+// in the opposite direction.
+func respondToOffer(w http.ResponseWriter, r *http.Request, action int) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+	var userId = userContext.UserId
+
+	offerId := r.PathValue("id")
+	if offerId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid offer URL"})
+		return
+	}
+
+	var counter NewOffer
+	if action == OfferCountered {
+		if err := json.NewDecoder(r.Body).Decode(&counter); err != nil || counter.Amount <= 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid amount value"})
+			return
+		}
+		defer r.Body.Close()
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to respond to offer"})
+		return
+	}
+	defer tx.Rollback()
+
+	var offer Offer
+	var parentId sql.NullString
+	err = tx.QueryRow(`
+		SELECT o_id, product_id, buyer, seller, sender, amount, status_id, parent_id, created, expires_at
+		FROM offer
+		WHERE o_id = $1
+		FOR UPDATE`,
+		offerId,
+	).Scan(&offer.OfferID, &offer.ProductID, &offer.Buyer, &offer.Seller, &offer.Sender,
+		&offer.Amount, &offer.Status, &parentId, &offer.Created, &offer.ExpiresAt)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Offer not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to respond to offer"})
+		return
+	}
+	offer.ParentID = parentId.String
+
+	if userId != offer.Buyer && userId != offer.Seller || userId == offer.Sender {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not Authorized"})
+		return
+	}
+
+	// The expirer may not have caught up with this offer yet
+	if offer.Status != OfferPending || offer.ExpiresAt.Before(time.Now()) {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Offer is no longer pending"})
+		return
+	}
+
+	now := time.Now()
+	_, err = tx.Exec("UPDATE offer SET status_id = $1, responded_at = $2 WHERE o_id = $3", action, now, offer.OfferID)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to respond to offer"})
+		return
+	}
+	offer.Status = action
+	offer.RespondedAt = &now
+
+	var content string
+	result := offer
+
+	switch action {
+	case OfferDeclined:
+		content = fmt.Sprintf("Declined offer of %.2f", offer.Amount)
+
+	case OfferCountered:
+		result = Offer{
+			ProductID: offer.ProductID,
+			Buyer:     offer.Buyer,
+			Seller:    offer.Seller,
+			Sender:    userId,
+			Amount:    counter.Amount,
+			Status:    OfferPending,
+			ParentID:  offer.OfferID,
+			ExpiresAt: offerExpiry(counter.ExpiresInHours),
+		}
+		err = tx.QueryRow(
+			"INSERT INTO offer (product_id, buyer, seller, sender, amount, status_id, parent_id, expires_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING o_id, created",
+			result.ProductID, result.Buyer, result.Seller, result.Sender, result.Amount, result.Status, result.ParentID, result.ExpiresAt,
+		).Scan(&result.OfferID, &result.Created)
+		if err != nil {
+			log.Printf("Error saving counter offer: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to respond to offer"})
+			return
+		}
+		content = fmt.Sprintf("Countered with %.2f", result.Amount)
+
+	case OfferAccepted:
+		var statusId int
+		// A removed listing cannot be sold, it counts as not active
+		err = tx.QueryRow(
+			"SELECT CASE WHEN deleted_at IS NULL THEN status_id ELSE 0 END FROM product WHERE p_id = $1 FOR UPDATE",
+			offer.ProductID,
+		).Scan(&statusId)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to respond to offer"})
+			return
+		}
+		if statusId != StatusActive {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Product is not available"})
+			return
+		}
+
+		_, err = tx.Exec("UPDATE product SET status_id = $1 WHERE p_id = $2", StatusReserved, offer.ProductID)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to reserve product"})
+			return
+		}
+
+		_, err = recordTransactionTx(tx, offer.ProductID, offer.Seller, offer.Buyer, StatusReserved, offer.Amount)
+		if err != nil {
+			log.Printf("Error recording transaction: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to reserve product"})
+			return
+		}
+
+		// The product is gone, so every other open offer on it is declined
+		_, err = tx.Exec(
+			"UPDATE offer SET status_id = $1, responded_at = $2 WHERE product_id = $3 AND status_id = $4",
+			OfferDeclined, now, offer.ProductID, OfferPending,
+		)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to respond to offer"})
+			return
+		}
+		content = fmt.Sprintf("Accepted offer of %.2f", offer.Amount)
+	}
+
+	if err := insertOfferMessage(tx, result, userId, content); err != nil {
+		log.Printf("Error saving offer message: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to respond to offer"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to respond to offer"})
+		return
+	}
+
+	pushOfferEvent(result, userId, content)
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(result); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
@@ -0,0 +1,986 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"ibuy-server/db"
+	"ibuy-server/payment"
+	"io"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+)
+
+// Order status ids as seeded in db/tables.sql
+const (
+	OrderPending   = 1
+	OrderPaid      = 2
+	OrderShipped   = 3
+	OrderCompleted = 4
+	OrderCancelled = 5
+	OrderRefunded  = 6
+	OrderDisputed  = 7
+)
+
+// orderTransitions lists the statuses an order may move to from each status
+var orderTransitions = map[int][]int{
+	OrderPending:  {OrderPaid, OrderCancelled},
+	OrderPaid:     {OrderShipped, OrderRefunded, OrderDisputed},
+	OrderShipped:  {OrderCompleted, OrderRefunded, OrderDisputed},
+	OrderDisputed: {OrderCompleted, OrderRefunded},
+}
+
+// orderCanMove tells whether an order may move to a status. Picked up orders are never
+// shipped, the buyer completes them straight from paid once the item was handed over.
+func orderCanMove(order *Order, status int) bool {
+	if order.Status == OrderPaid && status == OrderCompleted {
+		return order.ShippingMethod == ShippingPickup
+	}
+	return slices.Contains(orderTransitions[order.Status], status)
+}
+
+// orderTimestampColumns maps a status to the column recording when it was reached
+var orderTimestampColumns = map[int]string{
+	OrderPaid:      "paid_at",
+	OrderShipped:   "shipped_at",
+	OrderCompleted: "completed_at",
+	OrderCancelled: "cancelled_at",
+	OrderRefunded:  "refunded_at",
+	OrderDisputed:  "disputed_at",
+}
+
+const orderColumns = `ord_id, product_id, buyer, seller, amount, status_id, payment_provider, payment_reference,
+	created, updated, paid_at, shipped_at, completed_at, cancelled_at, refunded_at,
+	escrow, release_at, released_at, disputed_at, dispute_reason, resolved_at, resolution,
+	shipping_method, shipping_cost, shipping_address, tracking_number, carrier, refund_status, refund_amount`
+
+// Refund states of an order. A refund is pending from the moment the order is refunded,
+// or a payment arrived that cannot be applied to it, until the payment provider paid the
+// money back.
+const (
+	RefundPending = "pending"
+	RefundDone    = "done"
+)
+
+var ErrInvalidOrderTransition = errors.New("invalid order status transition")
+
+var Payments payment.PaymentProvider
+
+type Order struct {
+	OrderID          string     `json:"orderId"`
+	ProductID        string     `json:"productId"`
+	Buyer            string     `json:"buyer"`
+	Seller           string     `json:"seller"`
+	Amount           float32    `json:"amount"`
+	Status           int        `json:"status"`
+	PaymentProvider  string     `json:"paymentProvider"`
+	PaymentReference string     `json:"paymentReference"`
+	Created          time.Time  `json:"created"`
+	Updated          time.Time  `json:"updated"`
+	PaidAt           *time.Time `json:"paidAt"`
+	ShippedAt        *time.Time `json:"shippedAt"`
+	CompletedAt      *time.Time `json:"completedAt"`
+	CancelledAt      *time.Time `json:"cancelledAt"`
+	RefundedAt       *time.Time `json:"refundedAt"`
+	Escrow           bool       `json:"escrow"`
+	ReleaseAt        *time.Time `json:"releaseAt"`
+	ReleasedAt       *time.Time `json:"releasedAt"`
+	DisputedAt       *time.Time `json:"disputedAt"`
+	DisputeReason    string     `json:"disputeReason"`
+	ResolvedAt       *time.Time `json:"resolvedAt"`
+	Resolution       string     `json:"resolution"`
+	ShippingMethod   string     `json:"shippingMethod"`
+	ShippingCost     float32    `json:"shippingCost"`
+	ShippingAddress  *Address   `json:"shippingAddress"`
+	TrackingNumber   string     `json:"trackingNumber"`
+	Carrier          string     `json:"carrier"`
+	RefundStatus     string     `json:"refundStatus"`
+	RefundAmount     float32    `json:"refundAmount"`
+}
+
+type NewOrder struct {
+	ShippingMethod string `json:"shippingMethod"`
+	AddressID      string `json:"addressId"`
+}
+
+type TrackingRequest struct {
+	TrackingNumber string `json:"trackingNumber"`
+	Carrier        string `json:"carrier"`
+}
+
+type CheckoutResponse struct {
+	Order       Order  `json:"order"`
+	CheckoutURL string `json:"checkoutUrl"`
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func nullTimePtr(t sql.NullTime) *time.Time {
+	if !t.Valid {
+		return nil
+	}
+	return &t.Time
+}
+
+// scanOrder reads a row selected with orderColumns
+func scanOrder(row rowScanner) (Order, error) {
+	var order Order
+	var reference, disputeReason, resolution, trackingNumber, carrier, refundStatus sql.NullString
+	var shippingAddress []byte
+	var refundAmount sql.NullFloat64
+	var paidAt, shippedAt, completedAt, cancelledAt, refundedAt sql.NullTime
+	var releaseAt, releasedAt, disputedAt, resolvedAt sql.NullTime
+
+	err := row.Scan(
+		&order.OrderID,
+		&order.ProductID,
+		&order.Buyer,
+		&order.Seller,
+		&order.Amount,
+		&order.Status,
+		&order.PaymentProvider,
+		&reference,
+		&order.Created,
+		&order.Updated,
+		&paidAt,
+		&shippedAt,
+		&completedAt,
+		&cancelledAt,
+		&refundedAt,
+		&order.Escrow,
+		&releaseAt,
+		&releasedAt,
+		&disputedAt,
+		&disputeReason,
+		&resolvedAt,
+		&resolution,
+		&order.ShippingMethod,
+		&order.ShippingCost,
+		&shippingAddress,
+		&trackingNumber,
+		&carrier,
+		&refundStatus,
+		&refundAmount,
+	)
+	if err != nil {
+		return order, err
+	}
+
+	if shippingAddress != nil {
+		order.ShippingAddress = &Address{}
+		if err := json.Unmarshal(shippingAddress, order.ShippingAddress); err != nil {
+			return order, err
+		}
+	}
+
+	order.PaymentReference = reference.String
+	order.PaidAt = nullTimePtr(paidAt)
+	order.ShippedAt = nullTimePtr(shippedAt)
+	order.CompletedAt = nullTimePtr(completedAt)
+	order.CancelledAt = nullTimePtr(cancelledAt)
+	order.RefundedAt = nullTimePtr(refundedAt)
+	order.ReleaseAt = nullTimePtr(releaseAt)
+	order.ReleasedAt = nullTimePtr(releasedAt)
+	order.DisputedAt = nullTimePtr(disputedAt)
+	order.DisputeReason = disputeReason.String
+	order.ResolvedAt = nullTimePtr(resolvedAt)
+	order.Resolution = resolution.String
+	order.TrackingNumber = trackingNumber.String
+	order.Carrier = carrier.String
+	order.RefundStatus = refundStatus.String
+	order.RefundAmount = float32(refundAmount.Float64)
+	return order, nil
+}
+
+// transitionOrder moves an order to a new status and keeps the product status, its
+// transaction record and the ledger in line: a completed order sells the product,
+// a cancelled or refunded one puts it back on sale.
+func transitionOrder(tx *sql.Tx, order *Order, status int) error {
+	if !orderCanMove(order, status) {
+		return ErrInvalidOrderTransition
+	}
+
+	now := time.Now()
+	_, err := tx.Exec(
+		"UPDATE product_order SET status_id = $1, updated = $2, "+orderTimestampColumns[status]+" = $2 WHERE ord_id = $3",
+		status, now, order.OrderID,
+	)
+	if err != nil {
+		return err
+	}
+
+	if status == OrderShipped && order.Escrow {
+		releaseAt := now.Add(Escrow.ReleaseAfter)
+		if _, err := tx.Exec("UPDATE product_order SET release_at = $1 WHERE ord_id = $2", releaseAt, order.OrderID); err != nil {
+			return err
+		}
+		order.ReleaseAt = &releaseAt
+	}
+
+	if err := settleOrderFunds(tx, order, status, now); err != nil {
+		return err
+	}
+
+	switch status {
+	case OrderCompleted:
+		if _, err := tx.Exec("UPDATE product SET status_id = $1 WHERE p_id = $2", StatusSold, order.ProductID); err != nil {
+			return err
+		}
+		if _, err := recordTransactionTx(tx, order.ProductID, order.Seller, order.Buyer, StatusSold, order.Amount); err != nil {
+			return err
+		}
+	case OrderCancelled, OrderRefunded:
+		if _, err := tx.Exec("UPDATE product SET status_id = $1 WHERE p_id = $2", StatusActive, order.ProductID); err != nil {
+			return err
+		}
+		if err := cancelOpenTransactionTx(tx, order.ProductID, order.Seller); err != nil {
+			return err
+		}
+	}
+
+	order.Status = status
+	order.Updated = now
+	switch status {
+	case OrderPaid:
+		order.PaidAt = &now
+	case OrderShipped:
+		order.ShippedAt = &now
+	case OrderCompleted:
+		order.CompletedAt = &now
+	case OrderCancelled:
+		order.CancelledAt = &now
+	case OrderRefunded:
+		order.RefundedAt = &now
+	case OrderDisputed:
+		order.DisputedAt = &now
+	}
+	return nil
+}
+
+// productHasOpenOrder tells whether a product belongs to an order that is not finished yet.
+// The product's status then follows the order and cannot be changed by hand.
+func productHasOpenOrder(q queryer, productId string) (bool, error) {
+	var open bool
+	err := q.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM product_order WHERE product_id = $1 AND status_id IN ($2, $3, $4, $5))",
+		productId, OrderPending, OrderPaid, OrderShipped, OrderDisputed,
+	).Scan(&open)
+	return open, err
+}
+
+// CreateOrder starts checkout for a listing. The product is reserved for the buyer
+// until the order is cancelled, refunded or completed. Shipped orders capture a copy
+// of the buyer's address and add the listing's shipping cost to the amount.
+func CreateOrder(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+	var userId = userContext.UserId
+
+	if Payments == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Checkout is not available"})
+		return
+	}
+
+	productId := r.PathValue("id")
+	if productId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid product URL"})
+		return
+	}
+
+	var newOrder NewOrder
+	if err := json.NewDecoder(r.Body).Decode(&newOrder); err != nil && err != io.EOF {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	defer r.Body.Close()
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create order"})
+		return
+	}
+	defer tx.Rollback()
+
+	var sellerId, shippingOption string
+	var price, shippingCost float32
+	var statusId int
+	err = tx.QueryRow(
+		"SELECT u_id, price, status_id, shipping_option, shipping_cost FROM product WHERE p_id = $1 AND deleted_at IS NULL FOR UPDATE", productId,
+	).Scan(&sellerId, &price, &statusId, &shippingOption, &shippingCost)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create order"})
+		return
+	}
+
+	if sellerId == userId {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You cannot order your own product"})
+		return
+	}
+
+	amount := price
+	switch statusId {
+	case StatusActive:
+	case StatusReserved:
+		// A product reserved for this buyer (e.g. by an accepted offer) is bought at the agreed price
+		var buyerId string
+		err = tx.QueryRow(
+			"SELECT buyer, price FROM product_transaction WHERE product_id = $1 AND cancelled_at IS NULL",
+			productId,
+		).Scan(&buyerId, &amount)
+		if err != nil && err != sql.ErrNoRows {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create order"})
+			return
+		}
+		if err == sql.ErrNoRows || buyerId != userId {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Product is not available"})
+			return
+		}
+	default:
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Product is not available"})
+		return
+	}
+
+	if newOrder.ShippingMethod == "" {
+		newOrder.ShippingMethod = ShippingPickup
+		if shippingOption == ShippingDelivery {
+			newOrder.ShippingMethod = ShippingDelivery
+		}
+	}
+
+	var shippingAddress sql.NullString
+	switch newOrder.ShippingMethod {
+	case ShippingPickup:
+		if shippingOption == ShippingDelivery {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "This product can only be shipped"})
+			return
+		}
+		shippingCost = 0
+	case ShippingDelivery:
+		if shippingOption == ShippingPickup {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "This product is pickup only"})
+			return
+		}
+
+		address, err := scanAddress(tx.QueryRow(
+			"SELECT "+addressColumns+" FROM address WHERE a_id = $1 AND u_id = $2", newOrder.AddressID, userId,
+		))
+		if err != nil {
+			if err == sql.ErrNoRows {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "A shipping address from your address book is required"})
+				return
+			}
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create order"})
+			return
+		}
+
+		addressJSON, err := json.Marshal(address)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create order"})
+			return
+		}
+		shippingAddress = sql.NullString{String: string(addressJSON), Valid: true}
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid shippingMethod value"})
+		return
+	}
+	amount += shippingCost
+
+	hasOpenOrder, err := productHasOpenOrder(tx, productId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create order"})
+		return
+	}
+	if hasOpenOrder {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Product already has an open order"})
+		return
+	}
+
+	row := tx.QueryRow(`
+		INSERT INTO product_order (product_id, buyer, seller, amount, status_id, payment_provider, escrow, shipping_method, shipping_cost, shipping_address)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING `+orderColumns,
+		productId, userId, sellerId, amount, OrderPending, Payments.Name(), amount >= Escrow.MinAmount,
+		newOrder.ShippingMethod, shippingCost, shippingAddress,
+	)
+	order, err := scanOrder(row)
+	if err != nil {
+		log.Printf("Error saving order: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create order"})
+		return
+	}
+
+	if _, err := tx.Exec("UPDATE product SET status_id = $1 WHERE p_id = $2", StatusReserved, productId); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to reserve product"})
+		return
+	}
+
+	if _, err := recordTransactionTx(tx, productId, sellerId, userId, StatusReserved, amount-shippingCost); err != nil {
+		log.Printf("Error recording transaction: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to reserve product"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create order"})
+		return
+	}
+
+	// The provider is only called for a committed order and without holding its locks.
+	// When the payment cannot be started or linked, the order is cancelled again.
+	checkout, err := Payments.CreatePayment(order.OrderID, amount)
+	if err != nil {
+		log.Printf("Error creating payment: %v", err)
+		if err := cancelUnpaidOrder(order.OrderID); err != nil {
+			log.Printf("Error cancelling order %s: %v", order.OrderID, err)
+		}
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to start payment"})
+		return
+	}
+	order.PaymentReference = checkout.Reference
+
+	result, err := db.DB.Exec(
+		"UPDATE product_order SET payment_reference = $1 WHERE ord_id = $2 AND status_id = $3",
+		checkout.Reference, order.OrderID, OrderPending,
+	)
+	if err == nil {
+		if linked, rowsErr := result.RowsAffected(); rowsErr != nil || linked == 0 {
+			err = fmt.Errorf("order %s is no longer pending", order.OrderID)
+		}
+	}
+	if err != nil {
+		log.Printf("Error saving payment reference: %v", err)
+		cancelCheckout(&order)
+		if err := cancelUnpaidOrder(order.OrderID); err != nil {
+			log.Printf("Error cancelling order %s: %v", order.OrderID, err)
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create order"})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+
+	if err := json.NewEncoder(w).Encode(CheckoutResponse{Order: order, CheckoutURL: checkout.CheckoutURL}); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+func GetOrder(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	orderId := r.PathValue("id")
+	if orderId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid order URL"})
+		return
+	}
+
+	order, err := scanOrder(db.DB.QueryRow("SELECT "+orderColumns+" FROM product_order WHERE ord_id = $1", orderId))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Order not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get order"})
+		return
+	}
+
+	if order.Buyer != userContext.UserId && order.Seller != userContext.UserId {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not Authorized"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(order); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+// GetUserOrders lists the orders the current user placed or received
+func GetUserOrders(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	rows, err := db.DB.Query(
+		"SELECT "+orderColumns+" FROM product_order WHERE buyer = $1 OR seller = $1 ORDER BY created DESC",
+		userContext.UserId,
+	)
+	if err != nil {
+		log.Printf("Error querying orders: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get orders"})
+		return
+	}
+	defer rows.Close()
+
+	orders := []Order{}
+	for rows.Next() {
+		order, err := scanOrder(rows)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get all order info"})
+			return
+		}
+		orders = append(orders, order)
+	}
+
+	if err = rows.Err(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read orders"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(orders); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+func ShipOrder(w http.ResponseWriter, r *http.Request) {
+	updateOrderStatus(w, r, OrderShipped)
+}
+
+func CompleteOrder(w http.ResponseWriter, r *http.Request) {
+	updateOrderStatus(w, r, OrderCompleted)
+}
+
+func CancelOrder(w http.ResponseWriter, r *http.Request) {
+	updateOrderStatus(w, r, OrderCancelled)
+}
+
+func RefundOrder(w http.ResponseWriter, r *http.Request) {
+	updateOrderStatus(w, r, OrderRefunded)
+}
+
+// updateOrderStatus applies a user driven status change. The seller ships and refunds,
+// the buyer confirms completion, either party may cancel an unpaid order.
+func updateOrderStatus(w http.ResponseWriter, r *http.Request, status int) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+	var userId = userContext.UserId
+
+	orderId := r.PathValue("id")
+	if orderId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid order URL"})
+		return
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update order"})
+		return
+	}
+	defer tx.Rollback()
+
+	order, err := scanOrder(tx.QueryRow("SELECT "+orderColumns+" FROM product_order WHERE ord_id = $1 FOR UPDATE", orderId))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Order not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update order"})
+		return
+	}
+
+	if order.Status == OrderDisputed {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Order is disputed and awaits resolution"})
+		return
+	}
+
+	var allowed bool
+	switch status {
+	case OrderShipped, OrderRefunded:
+		allowed = userId == order.Seller
+	case OrderCompleted:
+		allowed = userId == order.Buyer
+	case OrderCancelled:
+		allowed = userId == order.Buyer || userId == order.Seller
+	}
+	if !allowed {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not Authorized"})
+		return
+	}
+
+	if err := transitionOrder(tx, &order, status); err != nil {
+		if err == ErrInvalidOrderTransition {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Order cannot move to this status"})
+			return
+		}
+		log.Printf("Error updating order: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update order"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update order"})
+		return
+	}
+
+	// The checkout of an order cancelled before it was paid must not take money anymore
+	if status == OrderCancelled {
+		cancelCheckout(&order)
+	}
+
+	w.WriteHeader(refundResponseStatus(&order))
+
+	if err := json.NewEncoder(w).Encode(order); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+// AddTracking lets the seller attach or correct the tracking number of a shipped order
+func AddTracking(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	orderId := r.PathValue("id")
+	if orderId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid order URL"})
+		return
+	}
+
+	var req TrackingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.TrackingNumber == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "A tracking number is required"})
+		return
+	}
+	defer r.Body.Close()
+
+	order, err := scanOrder(db.DB.QueryRow("SELECT "+orderColumns+" FROM product_order WHERE ord_id = $1", orderId))
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Order not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to add tracking number"})
+		return
+	}
+
+	if order.Seller != userContext.UserId {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not Authorized"})
+		return
+	}
+
+	if order.ShippingMethod != ShippingDelivery {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Order is picked up, not shipped"})
+		return
+	}
+
+	if order.Status != OrderPaid && order.Status != OrderShipped {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Tracking can only be added to paid or shipped orders"})
+		return
+	}
+
+	_, err = db.DB.Exec(
+		"UPDATE product_order SET tracking_number = $1, carrier = $2, updated = $3 WHERE ord_id = $4",
+		req.TrackingNumber, req.Carrier, time.Now(), orderId,
+	)
+	if err != nil {
+		log.Printf("Error saving tracking number: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to add tracking number"})
+		return
+	}
+	order.TrackingNumber = req.TrackingNumber
+	order.Carrier = req.Carrier
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(order); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+// PaymentWebhook receives payment confirmations from the payment provider.
+// It is called without a user session, so the request is trusted only after
+// the provider verified its signature.
+func PaymentWebhook(w http.ResponseWriter, r *http.Request) {
+	if Payments == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Payments are not configured"})
+		return
+	}
+
+	payload, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	defer r.Body.Close()
+
+	event, err := Payments.ParseWebhook(payload, r.Header.Get("X-Payment-Signature"))
+	if err != nil {
+		log.Printf("Rejected payment webhook: %v", err)
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid signature"})
+		return
+	}
+
+	if err := applyPaymentEvent(event); err != nil {
+		switch err {
+		case sql.ErrNoRows:
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Order not found"})
+		case ErrInvalidOrderTransition:
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Order cannot move to this status"})
+		default:
+			log.Printf("Error applying payment event: %v", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to process payment event"})
+		}
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Payment event processed"})
+}
+
+// cancelUnpaidOrder cancels an order whose checkout could not be started, which puts
+// the product back on sale
+func cancelUnpaidOrder(orderId string) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	order, err := scanOrder(tx.QueryRow("SELECT "+orderColumns+" FROM product_order WHERE ord_id = $1 FOR UPDATE", orderId))
+	if err != nil {
+		return err
+	}
+	if order.Status != OrderPending {
+		return nil
+	}
+	if err := transitionOrder(tx, &order, OrderCancelled); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// cancelCheckout voids the provider payment of a cancelled order. Should the payment
+// succeed anyway, the webhook pays it back.
+func cancelCheckout(order *Order) {
+	if Payments == nil || order.PaymentReference == "" {
+		return
+	}
+	if err := Payments.CancelPayment(order.PaymentReference); err != nil {
+		log.Printf("Error cancelling payment %s of order %s: %v", order.PaymentReference, order.OrderID, err)
+	}
+}
+
+// applyPaymentEvent marks the order behind a payment as paid or cancelled.
+// Providers may deliver an event more than once, so repeats are ignored. Money that
+// arrives for an order that can no longer take it is paid back.
+func applyPaymentEvent(event payment.WebhookEvent) error {
+	var status int
+	switch event.Type {
+	case payment.EventPaymentSucceeded:
+		status = OrderPaid
+	case payment.EventPaymentFailed:
+		status = OrderCancelled
+	default:
+		log.Printf("Ignoring payment event of type %s", event.Type)
+		return nil
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	order, err := scanOrder(tx.QueryRow("SELECT "+orderColumns+" FROM product_order WHERE payment_reference = $1 FOR UPDATE", event.Reference))
+	if err != nil {
+		return err
+	}
+
+	if order.Status == status {
+		return nil
+	}
+
+	switch {
+	case status == OrderCancelled && order.Status != OrderPending:
+		log.Printf("Ignoring failed payment %s of order %s in status %d", event.Reference, order.OrderID, order.Status)
+		return nil
+	case status == OrderPaid && (order.PaidAt != nil || order.RefundStatus != ""):
+		// Already booked, or already being paid back
+		return nil
+	case status == OrderPaid && (order.Status != OrderPending || event.Amount != order.Amount):
+		log.Printf("Payment %s of %.2f cannot be applied to order %s (status %d, amount %.2f), paying it back",
+			event.Reference, event.Amount, order.OrderID, order.Status, order.Amount)
+		if err := holdUnexpectedPayment(tx, &order, event.Amount); err != nil {
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		// A failed refund stays pending and is retried by the escrow releaser
+		if err := refundOrder(&order); err != nil {
+			log.Printf("Error refunding order %s, will retry: %v", order.OrderID, err)
+		}
+		return nil
+	}
+
+	if err := transitionOrder(tx, &order, status); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	if status == OrderPaid {
+		notifyAsync(order.Seller, NotificationSold, fmt.Sprintf("Your listing was sold for %.2f", order.Amount), order.ProductID)
+	}
+	return nil
+}
+
+// ConfirmFakePayment stands in for the provider's hosted checkout page during development.
+// It sends a signed confirmation for the buyer's payment to the webhook handler.
+func ConfirmFakePayment(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	fake, ok := Payments.(*payment.FakeProvider)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Fake payments are disabled"})
+		return
+	}
+
+	reference := r.PathValue("reference")
+	var buyerId string
+	err := db.DB.QueryRow("SELECT buyer FROM product_order WHERE payment_reference = $1", reference).Scan(&buyerId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Payment not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to confirm payment"})
+		return
+	}
+
+	// Only the buyer can pay for their order
+	if buyerId != userContext.UserId {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not Authorized"})
+		return
+	}
+
+	event := payment.EventPaymentSucceeded
+	if r.URL.Query().Get("fail") == "true" {
+		event = payment.EventPaymentFailed
+	}
+
+	payload, signature, err := fake.SignedEvent(reference, event)
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Payment not found"})
+		return
+	}
+
+	webhookEvent, err := fake.ParseWebhook(payload, signature)
+	if err == nil {
+		err = applyPaymentEvent(webhookEvent)
+	}
+	if err != nil {
+		log.Printf("Error confirming fake payment: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to confirm payment"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Payment confirmed"})
+}
@@ -0,0 +1,27 @@
+package handlers
+
+import "testing"
+
+func TestOrderCanMove(t *testing.T) {
+	tests := []struct {
+		from           int
+		shippingMethod string
+		to             int
+		allowed        bool
+	}{
+		{OrderPending, ShippingPickup, OrderPaid, true},
+		{OrderPending, ShippingPickup, OrderCompleted, false},
+		{OrderPaid, ShippingPickup, OrderCompleted, true},
+		{OrderPaid, ShippingDelivery, OrderCompleted, false},
+		{OrderPaid, ShippingDelivery, OrderShipped, true},
+		{OrderShipped, ShippingDelivery, OrderCompleted, true},
+		{OrderCancelled, ShippingPickup, OrderPaid, false},
+		{OrderCompleted, ShippingPickup, OrderRefunded, false},
+	}
+	for _, tt := range tests {
+		order := &Order{Status: tt.from, ShippingMethod: tt.shippingMethod}
+		if got := orderCanMove(order, tt.to); got != tt.allowed {
+			t.Errorf("%s order from %d to %d: allowed = %v, want %v", tt.shippingMethod, tt.from, tt.to, got, tt.allowed)
+		}
+	}
+}
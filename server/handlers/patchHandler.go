@@ -0,0 +1,304 @@
+package handlers
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"ibuy-server/db"
+	"log"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// patchableFields are the product fields a merge patch may change
+var patchableFields = []string{
+	"name", "description", "price", "category", "condition", "location", "status", "shippingOption", "shippingCost",
+}
+
+// ifMatchVersion reads the product version from an If-Match header. It returns -1 for
+// "*", which matches any version.
+func ifMatchVersion(header string) (int, bool) {
+	header = strings.TrimSpace(header)
+	if header == "*" {
+		return -1, true
+	}
+	// Weak tags are compared like strong ones, the version identifies the whole row
+	tag := strings.TrimPrefix(header, "W/")
+	if len(tag) < 2 || tag[0] != '"' || tag[len(tag)-1] != '"' {
+		return 0, false
+	}
+	version, err := strconv.Atoi(tag[1 : len(tag)-1])
+	return version, err == nil
+}
+
+// applyMergePatch applies a JSON merge patch (RFC 7396) to the editable fields of a
+// product. A null value removes optional fields and is rejected for required ones.
+func applyMergePatch(product *ProductResponse, patch map[string]json.RawMessage) error {
+	for field, value := range patch {
+		if !slices.Contains(patchableFields, field) {
+			return fmt.Errorf("Field %s cannot be patched", field)
+		}
+
+		if bytes.Equal(bytes.TrimSpace(value), []byte("null")) {
+			switch field {
+			case "description":
+				product.Description = ""
+			case "condition":
+				product.Condition = ""
+			case "location":
+				product.Location = ""
+			case "category":
+				product.Category = 0
+			case "shippingCost":
+				product.ShippingCost = 0
+			default:
+				return fmt.Errorf("Field %s cannot be removed", field)
+			}
+			continue
+		}
+
+		var target any
+		switch field {
+		case "name":
+			target = &product.Name
+		case "description":
+			target = &product.Description
+		case "price":
+			target = &product.Price
+		case "category":
+			target = &product.Category
+		case "condition":
+			target = &product.Condition
+		case "location":
+			target = &product.Location
+		case "status":
+			target = &product.Status
+		case "shippingOption":
+			target = &product.ShippingOption
+		case "shippingCost":
+			target = &product.ShippingCost
+		}
+		if err := json.Unmarshal(value, target); err != nil {
+			return fmt.Errorf("Invalid %s value", field)
+		}
+	}
+	return nil
+}
+
+// PatchProduct partially updates a product with a JSON merge patch. The If-Match header
+// must carry the ETag the client last saw, so concurrent edits are not overwritten.
+func PatchProduct(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+	var userId = userContext.UserId
+
+	productId := r.PathValue("id")
+	if productId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid product URL"})
+		return
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "application/merge-patch+json" && mediaType != "application/json" {
+		w.WriteHeader(http.StatusUnsupportedMediaType)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Expected an application/merge-patch+json body"})
+		return
+	}
+
+	if r.Header.Get("If-Match") == "" {
+		w.WriteHeader(http.StatusPreconditionRequired)
+		json.NewEncoder(w).Encode(map[string]string{"error": "If-Match header with the product ETag is required"})
+		return
+	}
+	expectedVersion, ok := ifMatchVersion(r.Header.Get("If-Match"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid If-Match header"})
+		return
+	}
+
+	var patch map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&patch); err != nil || patch == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	defer r.Body.Close()
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update product"})
+		return
+	}
+	defer tx.Rollback()
+
+	var product ProductResponse
+	var ownerId string
+	var description, condition, location sql.NullString
+	err = tx.QueryRow(`
+		SELECT u_id, name, description, price, COALESCE(category_id, 0), condition, status_id, location,
+			shipping_option, shipping_cost, version
+		FROM product
+		WHERE p_id = $1 AND deleted_at IS NULL
+		FOR UPDATE`,
+		productId,
+	).Scan(&ownerId, &product.Name, &description, &product.Price, &product.Category, &condition, &product.Status,
+		&location, &product.ShippingOption, &product.ShippingCost, &product.Version)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("Error loading product %s for patch: %v", productId, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update product"})
+		return
+	}
+	if ownerId != userId {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not Authorized"})
+		return
+	}
+	if expectedVersion != -1 && expectedVersion != product.Version {
+		w.Header().Set("ETag", productETag(product.Version))
+		w.WriteHeader(http.StatusPreconditionFailed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Product was changed by someone else, reload it and try again"})
+		return
+	}
+	product.Description = description.String
+	product.Condition = condition.String
+	product.Location = location.String
+
+	previousPrice := product.Price
+	previousStatus := product.Status
+
+	if err := applyMergePatch(&product, patch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	// Same rules as UpdateProduct: drafts are only published through PublishProduct
+	// and published listings cannot become drafts again
+	switch {
+	case previousStatus == StatusDraft && product.Status != StatusDraft:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Drafts have to be published first"})
+		return
+	case previousStatus != StatusDraft && product.Status == StatusDraft:
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "A published product cannot be turned back into a draft"})
+		return
+	case product.Status != previousStatus && (product.Status == StatusSold || product.Status == StatusReserved):
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Selling or reserving a product needs its buyer, use the product update instead"})
+		return
+	case product.Status != previousStatus && !slices.Contains(bulkStatuses, product.Status):
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid status value"})
+		return
+	}
+
+	// While an order is open the product's status follows the order
+	if product.Status != previousStatus {
+		openOrder, err := productHasOpenOrder(tx, productId)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update product"})
+			return
+		}
+		if openOrder {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Product has an open order"})
+			return
+		}
+	}
+
+	if strings.TrimSpace(product.Name) == "" || product.Price < 0 || product.ShippingCost < 0 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Name is required and price and shippingCost cannot be negative"})
+		return
+	}
+	if !isValidShippingOption(product.ShippingOption) {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid shippingOption value"})
+		return
+	}
+	if product.Category == 0 && product.Status != StatusDraft {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Only drafts can be saved without a category"})
+		return
+	}
+	if product.Category != 0 {
+		var exists bool
+		if err := tx.QueryRow("SELECT EXISTS (SELECT 1 FROM category WHERE id = $1)", product.Category).Scan(&exists); err != nil || !exists {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Invalid category value"})
+			return
+		}
+	}
+
+	_, err = tx.Exec(`
+		UPDATE product
+		SET name = $1, description = $2, price = $3, category_id = NULLIF($4, 0), status_id = $5, condition = $6, location = $7,
+			shipping_option = $8, shipping_cost = $9,
+			expires_at = CASE WHEN $5 = $10 AND (status_id = $11 OR expires_at <= NOW()) THEN $12 ELSE expires_at END
+		WHERE p_id = $13`,
+		product.Name, product.Description, product.Price, product.Category, product.Status, product.Condition, product.Location,
+		product.ShippingOption, product.ShippingCost,
+		StatusActive, StatusExpired, time.Now().Add(Expiry.ListingPeriod),
+		productId,
+	)
+	if err == nil && product.Price != previousPrice {
+		err = recordPrice(tx, productId, product.Price)
+	}
+	if err == nil && product.Status == StatusActive && previousStatus != StatusActive {
+		err = cancelOpenTransactionTx(tx, productId, userId)
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		log.Printf("Error patching product %s: %v", productId, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update product"})
+		return
+	}
+
+	if product.Price < previousPrice {
+		go notifyWatchers(productId, NotificationPriceDrop,
+			fmt.Sprintf("%s dropped in price from %.2f to %.2f", product.Name, previousPrice, product.Price))
+	}
+	if product.Status != previousStatus {
+		go notifyWatchers(productId, NotificationStatusChange,
+			fmt.Sprintf("%s is now %s", product.Name, productStatusName(product.Status)))
+	}
+
+	updated, err := loadProduct(productId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get product"})
+		return
+	}
+
+	w.Header().Set("ETag", productETag(updated.Version))
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(updated); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
@@ -0,0 +1,185 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"ibuy-server/db"
+	"log"
+	"net/http"
+	"slices"
+)
+
+// Notification channels
+const (
+	ChannelInApp     = "in_app"
+	ChannelWebsocket = "websocket"
+	ChannelEmail     = "email"
+	ChannelPush      = "push"
+)
+
+var notificationChannels = []string{ChannelInApp, ChannelWebsocket, ChannelEmail, ChannelPush}
+
+// notificationEventTypes are the events users can configure
+var notificationEventTypes = []string{
+	NotificationMessage,
+	NotificationOffer,
+	NotificationReview,
+	NotificationSavedSearch,
+	NotificationSold,
+	NotificationPriceDrop,
+	NotificationStatusChange,
+	NotificationListingExpired,
+}
+
+// NotificationPreferences maps event type to channel to whether it is enabled
+type NotificationPreferences map[string]map[string]bool
+
+// notificationEnabled reports whether a user wants events of a type on a channel.
+// Channels are enabled unless the user turned them off.
+func notificationEnabled(userId, eventType, channel string) bool {
+	var enabled bool
+	err := db.DB.QueryRow(
+		"SELECT enabled FROM notification_preference WHERE u_id = $1 AND event_type = $2 AND channel = $3",
+		userId, eventType, channel,
+	).Scan(&enabled)
+	if err == sql.ErrNoRows {
+		return true
+	}
+	if err != nil {
+		log.Printf("Error reading notification preference of %s: %v", userId, err)
+		return false
+	}
+	return enabled
+}
+
+// loadNotificationPreferences returns every event type and channel of a user, filling in the defaults
+func loadNotificationPreferences(userId string) (NotificationPreferences, error) {
+	preferences := NotificationPreferences{}
+	for _, eventType := range notificationEventTypes {
+		preferences[eventType] = map[string]bool{}
+		for _, channel := range notificationChannels {
+			preferences[eventType][channel] = true
+		}
+	}
+
+	rows, err := db.DB.Query("SELECT event_type, channel, enabled FROM notification_preference WHERE u_id = $1", userId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var eventType, channel string
+		var enabled bool
+		if err := rows.Scan(&eventType, &channel, &enabled); err != nil {
+			return nil, err
+		}
+		if channels, ok := preferences[eventType]; ok {
+			channels[channel] = enabled
+		}
+	}
+	return preferences, rows.Err()
+}
+
+func GetNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	preferences, err := loadNotificationPreferences(userContext.UserId)
+	if err != nil {
+		log.Printf("Error querying notification preferences: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get notification preferences"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(preferences); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+// UpdateNotificationPreferences changes the channels given in the body and leaves the others as they are
+func UpdateNotificationPreferences(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	var updates NotificationPreferences
+	if err := json.NewDecoder(r.Body).Decode(&updates); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	defer r.Body.Close()
+
+	for eventType, channels := range updates {
+		if !slices.Contains(notificationEventTypes, eventType) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Unknown event type: " + eventType})
+			return
+		}
+		for channel := range channels {
+			if !slices.Contains(notificationChannels, channel) {
+				w.WriteHeader(http.StatusBadRequest)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Unknown channel: " + channel})
+				return
+			}
+		}
+	}
+
+	tx, err := db.DB.Begin()
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update notification preferences"})
+		return
+	}
+	defer tx.Rollback()
+
+	for eventType, channels := range updates {
+		for channel, enabled := range channels {
+			_, err := tx.Exec(`
+				INSERT INTO notification_preference (u_id, event_type, channel, enabled) VALUES ($1, $2, $3, $4)
+				ON CONFLICT (u_id, event_type, channel) DO UPDATE SET enabled = $4`,
+				userContext.UserId, eventType, channel, enabled,
+			)
+			if err != nil {
+				log.Printf("Error saving notification preference: %v", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update notification preferences"})
+				return
+			}
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update notification preferences"})
+		return
+	}
+
+	preferences, err := loadNotificationPreferences(userContext.UserId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get notification preferences"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(preferences); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"ibuy-server/db"
+	"log"
+	"net/http"
+	"time"
+)
+
+type PricePoint struct {
+	Price   float32   `json:"price"`
+	Created time.Time `json:"created"`
+}
+
+// previousPriceColumn selects the price product p had before its latest price change
+const previousPriceColumn = "(SELECT ph.price FROM price_history ph WHERE ph.product_id = p.p_id ORDER BY ph.created DESC, ph.id DESC OFFSET 1 LIMIT 1)"
+
+// execer is satisfied by both *sql.DB and *sql.Tx
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// queryer is satisfied by both *sql.DB and *sql.Tx
+type queryer interface {
+	execer
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// recordPrice appends a price to a product's history
+func recordPrice(e execer, productId string, price float32) error {
+	_, err := e.Exec("INSERT INTO price_history (product_id, price) VALUES ($1, $2)", productId, price)
+	return err
+}
+
+// setPreviousPrice fills in the price before the latest change and whether the product got cheaper
+func (p *ProductResponse) setPreviousPrice(previous sql.NullFloat64) {
+	if !previous.Valid {
+		return
+	}
+	price := float32(previous.Float64)
+	p.PreviousPrice = &price
+	p.Reduced = p.Price < price
+}
+
+// GetPriceHistory returns every price a product had, oldest first
+func GetPriceHistory(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	productId := r.PathValue("id")
+	if productId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid product URL"})
+		return
+	}
+
+	var exists bool
+	err := db.DB.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM product WHERE p_id = $1 AND deleted_at IS NULL AND (status_id <> $2 OR u_id = $3))",
+		productId, StatusDraft, userContext.UserId,
+	).Scan(&exists)
+	if err != nil || !exists {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+		return
+	}
+
+	rows, err := db.DB.Query("SELECT price, created FROM price_history WHERE product_id = $1 ORDER BY created, id", productId)
+	if err != nil {
+		log.Printf("Error querying price history: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get price history"})
+		return
+	}
+	defer rows.Close()
+
+	history := []PricePoint{}
+	for rows.Next() {
+		var point PricePoint
+		if err := rows.Scan(&point.Price, &point.Created); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get all price history info"})
+			return
+		}
+		history = append(history, point)
+	}
+
+	if err = rows.Err(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read price history"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(history); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
@@ -3,6 +3,7 @@ package handlers
 import (
 	"database/sql"
 	"encoding/json"
+	"fmt"
 	"ibuy-server/db"
 	"log"
 	"net/http"
@@ -20,6 +21,8 @@ type NewProduct struct {
 	Condition   string     `json:"condition"`
 	Location    string  `json:"location"`
 	Description string  `json:"description"`
+	ShippingOption string  `json:"shippingOption"`
+	ShippingCost   float32 `json:"shippingCost"`
 }
 
 type UpdatedProduct struct {
@@ -31,6 +34,10 @@ type UpdatedProduct struct {
 	Location    string  `json:"location"`
 	Description string  `json:"description"`
     DeletedImages []string `json:"deletedImages"`
+    ShippingOption string  `json:"shippingOption"`
+    ShippingCost   *float32 `json:"shippingCost"`
+    Buyer       string  `json:"buyer"`
+    AgreedPrice float32 `json:"agreedPrice"`
 }
 
 type ProductResponse struct {
@@ -44,7 +51,27 @@ type ProductResponse struct {
     Location    string   `json:"location"`
     Description string   `json:"description"`
     Created    time.Time `json:"created"`
-    Images      []string `json:"images"` // Base64-encoded image data
+    ShippingOption string `json:"shippingOption"`
+    ShippingCost   float32 `json:"shippingCost"`
+    Watchers    int      `json:"watchers"`
+    PreviousPrice *float32 `json:"previousPrice,omitempty"` // price before the latest change
+    Reduced     bool     `json:"reduced"`
+    ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+    PublishAt   *time.Time `json:"publishAt,omitempty"` // scheduled publishing time of a draft
+    Version     int      `json:"version"`
+    Images      []string `json:"images"` // stored image paths, identifying images in updates
+    ImageVariants []ImageVariants `json:"imageVariants"` // resized versions of Images, in the same order
+}
+
+// Shipping options a seller can offer for a listing
+const (
+    ShippingPickup   = "pickup"
+    ShippingDelivery = "shipping"
+    ShippingBoth     = "both"
+)
+
+func isValidShippingOption(option string) bool {
+    return option == ShippingPickup || option == ShippingDelivery || option == ShippingBoth
 }
 
 func AddProduct(w http.ResponseWriter, r *http.Request) {
@@ -56,7 +83,8 @@ func AddProduct(w http.ResponseWriter, r *http.Request) {
     }
     var userId = userContext.UserId
 
-    // Parse multipart form instead of JSON
+    // Parse multipart form instead of JSON, the body cannot be much larger than the images allowed in it
+    r.Body = http.MaxBytesReader(w, r.Body, ImageLimits.MaxListingSize+1<<20)
     err := r.ParseMultipartForm(32 << 20) // 32MB max
     if err != nil {
         w.WriteHeader(http.StatusBadRequest)
@@ -70,6 +98,26 @@ func AddProduct(w http.ResponseWriter, r *http.Request) {
         Description: r.FormValue("description"),
         Location:    r.FormValue("location"),
         Condition:   r.FormValue("condition"),
+        ShippingOption: r.FormValue("shippingOption"),
+    }
+
+    if newProduct.ShippingOption == "" {
+        newProduct.ShippingOption = ShippingPickup
+    }
+    if !isValidShippingOption(newProduct.ShippingOption) {
+        w.WriteHeader(http.StatusBadRequest)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Invalid shippingOption value"})
+        return
+    }
+
+    if shippingCost := r.FormValue("shippingCost"); shippingCost != "" {
+        if c, err := strconv.ParseFloat(shippingCost, 32); err == nil && c >= 0 {
+            newProduct.ShippingCost = float32(c)
+        } else {
+            w.WriteHeader(http.StatusBadRequest)
+            json.NewEncoder(w).Encode(map[string]string{"error": "Invalid shippingCost value"})
+            return
+        }
     }
 
     // Parse numeric fields with error handling
@@ -93,11 +141,63 @@ func AddProduct(w http.ResponseWriter, r *http.Request) {
         }
     }
 
+    // Drafts may be incomplete and stay hidden until they are published, a publishAt time schedules that
+    status := StatusActive
+    var publishAt, expiresAt *time.Time
+    if r.FormValue("draft") == "true" {
+        status = StatusDraft
+    }
+    if value := r.FormValue("publishAt"); value != "" {
+        t, err := time.Parse(time.RFC3339, value)
+        if err != nil || !t.After(time.Now()) {
+            w.WriteHeader(http.StatusBadRequest)
+            json.NewEncoder(w).Encode(map[string]string{"error": "publishAt must be a future RFC 3339 time"})
+            return
+        }
+        status = StatusDraft
+        publishAt = &t
+    }
+
+    if status != StatusDraft || publishAt != nil {
+        category := sql.NullInt32{Int32: int32(newProduct.Category), Valid: newProduct.Category != 0}
+        if missing := missingListingFields(newProduct.Name, category); len(missing) > 0 {
+            w.WriteHeader(http.StatusBadRequest)
+            json.NewEncoder(w).Encode(map[string]string{"error": "Missing required fields: " + strings.Join(missing, ", ")})
+            return
+        }
+    }
+    if status == StatusActive {
+        t := time.Now().Add(Expiry.ListingPeriod)
+        expiresAt = &t
+    }
+
+    // Images are checked before anything is stored, every rejected file is reported
+    uploads, imageProblems, err := readImageUploads(r, 0)
+    if err != nil {
+        w.WriteHeader(http.StatusBadRequest)
+        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+        return
+    }
+    if len(imageProblems) > 0 {
+        writeImageErrors(w, imageProblems)
+        return
+    }
+
+    // The product and its images are saved together, files of a failed attempt are removed again
+    tx, err := db.DB.Begin()
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create product"})
+        return
+    }
+    defer tx.Rollback()
+
     var productId string
 
-    err = db.DB.QueryRow(
-        "INSERT INTO product (name, description, price, u_id, category_id, status_id, condition, location) VALUES ($1, $2, $3, $4, $5, $6, $7, $8) RETURNING p_id",
-        newProduct.Name, newProduct.Description, newProduct.Price, userId, newProduct.Category, 1, newProduct.Condition, newProduct.Location,
+    err = tx.QueryRow(
+        "INSERT INTO product (name, description, price, u_id, category_id, status_id, condition, location, shipping_option, shipping_cost, expires_at, publish_at) VALUES ($1, $2, $3, $4, NULLIF($5, 0), $6, $7, $8, $9, $10, $11, $12) RETURNING p_id",
+        newProduct.Name, newProduct.Description, newProduct.Price, userId, newProduct.Category, status, newProduct.Condition, newProduct.Location,
+        newProduct.ShippingOption, newProduct.ShippingCost, expiresAt, publishAt,
     ).Scan(&productId)
 
     if err != nil {
@@ -106,11 +206,16 @@ func AddProduct(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // Now handle image upload - the form is already parsed
-    imagePaths, err := UploadImageHandler(r, userId, productId)
-    if err != nil {
+    if err := recordPrice(tx, productId, newProduct.Price); err != nil {
         w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save images"})
+        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create product"})
+        return
+    }
+
+    // Now save the validated images
+    imagePaths, err := UploadImageHandler(uploads, userId, productId)
+    if err != nil {
+        writeImageSaveError(w, err, "Failed to save images")
         return
     }
 
@@ -123,27 +228,41 @@ func AddProduct(w http.ResponseWriter, r *http.Request) {
     }
 
     // Save URL paths (with forward slashes) to database
-    if len(urlPaths) > 0 {
-        query := "INSERT INTO product_image (product_id, image_path) SELECT $1, UNNEST($2::text[])"
-        _, err := db.DB.Exec(query, productId, pq.Array(urlPaths))
-        if err != nil {
-            w.WriteHeader(http.StatusInternalServerError)
-            json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save product images"})
-            return
-        }
+    if err := addProductImages(tx, productId, urlPaths); err != nil {
+        discardImageFiles(urlPaths)
+        w.WriteHeader(http.StatusInternalServerError)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save product images"})
+        return
+    }
+
+    if err := tx.Commit(); err != nil {
+        discardImageFiles(urlPaths)
+        w.WriteHeader(http.StatusInternalServerError)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to create product"})
+        return
     }
 
     productResponse := ProductResponse{
         ProductID:   productId,
+        UserID:      userId,
         Name:        newProduct.Name,
         Price:       newProduct.Price,
         Category:    newProduct.Category,
         Condition:   newProduct.Condition,
-        Status:      1,
+        Status:      status,
         Location:    newProduct.Location,
         Description: newProduct.Description,
+        ShippingOption: newProduct.ShippingOption,
+        ShippingCost:   newProduct.ShippingCost,
+        ExpiresAt:   expiresAt,
+        PublishAt:   publishAt,
         Images:      urlPaths, // Return URL paths instead of base64 images
     }
+    productResponse.setImageVariants()
+
+    if status == StatusActive {
+        go matchSavedSearches(productResponse)
+    }
 
     w.WriteHeader(http.StatusCreated)
 
@@ -172,7 +291,20 @@ func UpdateProduct(w http.ResponseWriter, r *http.Request){
 
     var userId = userContext.UserId
 
-    // Parse multipart form instead of JSON
+    // If-Match is optional here, when sent the update only applies to that version of the product
+    expectedVersion := -1
+    if ifMatch := r.Header.Get("If-Match"); ifMatch != "" {
+        version, ok := ifMatchVersion(ifMatch)
+        if !ok {
+            w.WriteHeader(http.StatusBadRequest)
+            json.NewEncoder(w).Encode(map[string]string{"error": "Invalid If-Match header"})
+            return
+        }
+        expectedVersion = version
+    }
+
+    // Parse multipart form instead of JSON, the body cannot be much larger than the images allowed in it
+    r.Body = http.MaxBytesReader(w, r.Body, ImageLimits.MaxListingSize+1<<20)
     err := r.ParseMultipartForm(32 << 20) // 32MB max
     if err != nil {
         w.WriteHeader(http.StatusBadRequest)
@@ -186,12 +318,34 @@ func UpdateProduct(w http.ResponseWriter, r *http.Request){
         Description: r.FormValue("description"),
         Location:    r.FormValue("location"),
         Condition:   r.FormValue("condition"),
+        ShippingOption: r.FormValue("shippingOption"),
+        Buyer:       r.FormValue("buyer"),
     }
 
-    // Parse numeric fields with error handling
+    // Shipping fields are optional, the stored values are kept when they are left out
+    if updateProduct.ShippingOption != "" && !isValidShippingOption(updateProduct.ShippingOption) {
+        w.WriteHeader(http.StatusBadRequest)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Invalid shippingOption value"})
+        return
+    }
+
+    if shippingCost := r.FormValue("shippingCost"); shippingCost != "" {
+        if c, err := strconv.ParseFloat(shippingCost, 32); err == nil && c >= 0 {
+            cost := float32(c)
+            updateProduct.ShippingCost = &cost
+        } else {
+            w.WriteHeader(http.StatusBadRequest)
+            json.NewEncoder(w).Encode(map[string]string{"error": "Invalid shippingCost value"})
+            return
+        }
+    }
+
+    // Parse numeric fields with error handling. An omitted price keeps the stored one.
+    priceSent := false
     if price := r.FormValue("price"); price != "" {
         if p, err := strconv.ParseFloat(price, 32); err == nil {
             updateProduct.Price = float32(p)
+            priceSent = true
         } else {
             w.WriteHeader(http.StatusBadRequest)
             json.NewEncoder(w).Encode(map[string]string{"error": "Invalid price value"})
@@ -229,15 +383,185 @@ func UpdateProduct(w http.ResponseWriter, r *http.Request){
         }
     }
 
+    agreedPriceSent := false
+    if agreedPrice := r.FormValue("agreedPrice"); agreedPrice != "" {
+        if p, err := strconv.ParseFloat(agreedPrice, 32); err == nil {
+            updateProduct.AgreedPrice = float32(p)
+            agreedPriceSent = true
+        } else {
+            w.WriteHeader(http.StatusBadRequest)
+            json.NewEncoder(w).Encode(map[string]string{"error": "Invalid agreedPrice value"})
+            return
+        }
+    }
+
+    // Images are checked against the limits of the listing with the images it keeps. They
+    // are decoded and stored before the product is locked, and removed again when the
+    // update does not go through.
+    var keptImages int
+    err = db.DB.QueryRow(`
+        SELECT COUNT(pi.image_path) FROM product p
+        LEFT JOIN product_image pi ON pi.product_id = p.p_id AND pi.image_path <> ALL(COALESCE($3::text[], '{}'))
+        WHERE p.p_id = $1 AND p.u_id = $2 AND p.deleted_at IS NULL
+        GROUP BY p.p_id`,
+        productId, userId, pq.Array(updateProduct.DeletedImages),
+    ).Scan(&keptImages)
+    if err == sql.ErrNoRows {
+        w.WriteHeader(http.StatusNotFound)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+        return
+    }
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update product"})
+        return
+    }
+    uploads, imageProblems, err := readImageUploads(r, keptImages)
+    if err != nil {
+        w.WriteHeader(http.StatusBadRequest)
+        json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+        return
+    }
+    if len(imageProblems) > 0 {
+        writeImageErrors(w, imageProblems)
+        return
+    }
+
+    imagePaths, err := UploadImageHandler(uploads, userId, productId)
+    if err != nil {
+        writeImageSaveError(w, err, "Failed to save new images")
+        return
+    }
+    // Convert file paths to URL paths and normalize to forward slashes
+    var newImagePaths []string
+    for _, path := range imagePaths {
+        urlPath := strings.ReplaceAll(path, "\\", "/")
+        newImagePaths = append(newImagePaths, urlPath)
+    }
+    committed := false
+    defer func() {
+        if !committed {
+            discardImageFiles(newImagePaths)
+        }
+    }()
+
+    // The product, its buyer and its images change together
+    tx, err := db.DB.Begin()
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update product"})
+        return
+    }
+    defer tx.Rollback()
+
+    // Remember price and status so watchers can be told about changes
+    var previousPrice float32
+    var previousStatus, currentVersion int
+    err = tx.QueryRow("SELECT price, status_id, version FROM product WHERE p_id = $1 AND u_id = $2 AND deleted_at IS NULL FOR UPDATE", productId, userId).Scan(&previousPrice, &previousStatus, &currentVersion)
+    if err == sql.ErrNoRows {
+        w.WriteHeader(http.StatusNotFound)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+        return
+    }
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update product"})
+        return
+    }
+    if expectedVersion != -1 && expectedVersion != currentVersion {
+        w.Header().Set("ETag", productETag(currentVersion))
+        w.WriteHeader(http.StatusPreconditionFailed)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Product was changed by someone else, reload it and try again"})
+        return
+    }
+
+    // Without a price nothing about the price changes, it is not recorded or announced
+    if !priceSent {
+        updateProduct.Price = previousPrice
+    }
+    if !agreedPriceSent {
+        updateProduct.AgreedPrice = updateProduct.Price
+    }
+
+    // Drafts are only published through PublishProduct and published listings cannot become drafts again
+    if previousStatus == StatusDraft {
+        updateProduct.Status = StatusDraft
+    } else if updateProduct.Status == StatusDraft {
+        w.WriteHeader(http.StatusBadRequest)
+        json.NewEncoder(w).Encode(map[string]string{"error": "A published product cannot be turned back into a draft"})
+        return
+    }
+
+    // While an order is open the product's status follows the order
+    if updateProduct.Status != previousStatus {
+        openOrder, err := productHasOpenOrder(tx, productId)
+        if err != nil {
+            w.WriteHeader(http.StatusInternalServerError)
+            json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update product"})
+            return
+        }
+        if openOrder {
+            w.WriteHeader(http.StatusConflict)
+            json.NewEncoder(w).Encode(map[string]string{"error": "Product has an open order"})
+            return
+        }
+    }
+
+    // Record who the product was reserved for or sold to, or release the buyer when it is back on sale
+    if (updateProduct.Status == StatusSold || updateProduct.Status == StatusReserved) && updateProduct.Buyer != "" {
+        _, err = recordTransaction(tx, productId, userId, updateProduct.Buyer, updateProduct.Status, updateProduct.AgreedPrice)
+        if err != nil {
+            switch err {
+            case sql.ErrNoRows:
+                w.WriteHeader(http.StatusNotFound)
+                json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+            case ErrNotProductOwner:
+                w.WriteHeader(http.StatusForbidden)
+                json.NewEncoder(w).Encode(map[string]string{"error": "Not Authorized"})
+            case ErrBuyerNotEligible:
+                w.WriteHeader(http.StatusBadRequest)
+                json.NewEncoder(w).Encode(map[string]string{"error": "Buyer must have messaged about this product"})
+            default:
+                log.Printf("Error recording transaction: %v", err)
+                w.WriteHeader(http.StatusInternalServerError)
+                json.NewEncoder(w).Encode(map[string]string{"error": "Failed to record buyer"})
+            }
+            return
+        }
+    } else if updateProduct.Status == StatusActive {
+        if err := cancelOpenTransactionTx(tx, productId, userId); err != nil {
+            log.Printf("Error cancelling transaction: %v", err)
+            w.WriteHeader(http.StatusInternalServerError)
+            json.NewEncoder(w).Encode(map[string]string{"error": "Failed to release buyer"})
+            return
+        }
+    }
+
     // Update the product in database
-    _, err = db.DB.Exec(`
+    var shippingOption string
+    var shippingCost float32
+    var watchers int
+    var expiresAt sql.NullTime
+    var version int
+    err = tx.QueryRow(`
         UPDATE product 
-        SET name = $1, description = $2, price = $3, category_id = $4, status_id = $5, condition = $6, location = $7
-        WHERE p_id = $8 AND u_id = $9`,
+        SET name = $1, description = $2, price = $3, category_id = NULLIF($4, 0), status_id = $5, condition = $6, location = $7,
+            shipping_option = COALESCE(NULLIF($10, ''), shipping_option), shipping_cost = COALESCE($11, shipping_cost),
+            expires_at = CASE WHEN $5 = $12 AND (status_id = $13 OR expires_at <= NOW()) THEN $14 ELSE expires_at END
+        WHERE p_id = $8 AND u_id = $9
+        RETURNING shipping_option, shipping_cost, (SELECT COUNT(*) FROM watchlist WHERE product_id = p_id), expires_at, version`,
         updateProduct.Name, updateProduct.Description, updateProduct.Price, 
         updateProduct.Category, updateProduct.Status, updateProduct.Condition, 
         updateProduct.Location, productId, userId,
-    )
+        updateProduct.ShippingOption, updateProduct.ShippingCost,
+        StatusActive, StatusExpired, time.Now().Add(Expiry.ListingPeriod),
+    ).Scan(&shippingOption, &shippingCost, &watchers, &expiresAt, &version)
+
+    if err == sql.ErrNoRows {
+        w.WriteHeader(http.StatusNotFound)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+        return
+    }
 
     if err != nil {
         log.Printf("In the if [%s]", err)
@@ -246,50 +570,71 @@ func UpdateProduct(w http.ResponseWriter, r *http.Request){
         return
     }
 
-    // Handle deleted images
-    if len(updateProduct.DeletedImages) > 0 {
-        // Delete image files from filesystem
-        err = DeleteImageFiles(updateProduct.DeletedImages)
-        if err != nil {
+    if updateProduct.Price != previousPrice {
+        if err := recordPrice(tx, productId, updateProduct.Price); err != nil {
             w.WriteHeader(http.StatusInternalServerError)
-            json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete image files"})
+            json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update product"})
             return
         }
+    }
 
-        // Remove deleted images from database
-        query := "DELETE FROM product_image WHERE product_id = $1 AND image_path = ANY($2)"
-        _, err = db.DB.Exec(query, productId, pq.Array(updateProduct.DeletedImages))
+    // Read with the price history this update just extended
+    var lastPrice sql.NullFloat64
+    err = tx.QueryRow("SELECT "+previousPriceColumn+" FROM product p WHERE p.p_id = $1", productId).Scan(&lastPrice)
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update product"})
+        return
+    }
+
+    // Remove deleted images from database, only paths that belong to the product are removed from disk
+    var removedImagePaths []string
+    if len(updateProduct.DeletedImages) > 0 {
+        rows, err := tx.Query(
+            "DELETE FROM product_image WHERE product_id = $1 AND image_path = ANY($2) RETURNING image_path",
+            productId, pq.Array(updateProduct.DeletedImages),
+        )
         if err != nil {
             w.WriteHeader(http.StatusInternalServerError)
             json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete product images from database"})
             return
         }
+        for rows.Next() {
+            var imagePath string
+            if err := rows.Scan(&imagePath); err == nil {
+                removedImagePaths = append(removedImagePaths, imagePath)
+            }
+        }
+        rows.Close()
     }
 
-    // Handle new image uploads
-    var newImagePaths []string
-    imagePaths, err := UploadImageHandler(r, userId, productId)
-    if err != nil {
+    // Save new image URL paths to database
+    if err := addProductImages(tx, productId, newImagePaths); err != nil {
         w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save new images"})
+        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save new product images"})
         return
     }
 
-    // Convert file paths to URL paths and normalize to forward slashes
-    for _, path := range imagePaths {
-        urlPath := strings.ReplaceAll(path, "\\", "/")
-        newImagePaths = append(newImagePaths, urlPath)
+    if err := tx.Commit(); err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to update product"})
+        return
     }
+    committed = true
 
-    // Save new image URL paths to database
-    if len(newImagePaths) > 0 {
-        query := "INSERT INTO product_image (product_id, image_path) SELECT $1, UNNEST($2::text[])"
-        _, err := db.DB.Exec(query, productId, pq.Array(newImagePaths))
-        if err != nil {
-            w.WriteHeader(http.StatusInternalServerError)
-            json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save new product images"})
-            return
-        }
+    // The rows are gone, so the files of deleted images can go too
+    discardImageFiles(removedImagePaths)
+
+    if updateProduct.Price < previousPrice {
+        go notifyWatchers(productId, NotificationPriceDrop,
+            fmt.Sprintf("%s dropped in price from %.2f to %.2f", updateProduct.Name, previousPrice, updateProduct.Price))
+    }
+    if updateProduct.Status != previousStatus {
+        go notifyWatchers(productId, NotificationStatusChange,
+            fmt.Sprintf("%s is now %s", updateProduct.Name, productStatusName(updateProduct.Status)))
+    }
+    if updateProduct.Status == StatusSold && previousStatus != StatusSold && updateProduct.Buyer != "" {
+        notifyAsync(updateProduct.Buyer, NotificationSold, fmt.Sprintf("%s was sold to you", updateProduct.Name), productId)
     }
 
     // Get all current images for the product to return in response
@@ -320,9 +665,18 @@ func UpdateProduct(w http.ResponseWriter, r *http.Request){
         Status:      updateProduct.Status,
         Location:    updateProduct.Location,
         Description: updateProduct.Description,
+        ShippingOption: shippingOption,
+        ShippingCost:   shippingCost,
+        Watchers:    watchers,
+        ExpiresAt:   nullTimePtr(expiresAt),
+        Version:     version,
         Images:      allImagePaths,
     }
 
+    productResponse.setPreviousPrice(lastPrice)
+    productResponse.setImageVariants()
+
+    w.Header().Set("ETag", productETag(version))
     w.WriteHeader(http.StatusOK)
 
     if err := json.NewEncoder(w).Encode(productResponse); err != nil {
@@ -332,20 +686,17 @@ func UpdateProduct(w http.ResponseWriter, r *http.Request){
     }
 }
 
-func GetProductById(w http.ResponseWriter, r *http.Request) {
-    path := r.URL.Path
-    parts := strings.Split(path, "/")
-
-    if len(parts) != 3 || parts[1] != "product" || parts[2] == "" {
-        w.WriteHeader(http.StatusBadRequest)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Invalid product URL"})
-        return
-    }
-
-    productId := parts[2]
+// productETag is the entity tag of a product version, as sent in ETag and If-Match headers
+func productETag(version int) string {
+    return fmt.Sprintf("\"%d\"", version)
+}
 
+// loadProduct reads a single product with its images
+func loadProduct(productId string) (ProductResponse, error) {
     var product ProductResponse
     var imagePathsStr sql.NullString
+    var previousPrice sql.NullFloat64
+    var expiresAt, publishAt sql.NullTime
 
     // Using string_agg to concatenate all image paths (PostgreSQL)
     query := `
@@ -354,17 +705,25 @@ func GetProductById(w http.ResponseWriter, r *http.Request) {
             p.u_id,
             p.name,
             p.price,
-            p.category_id,
+            COALESCE(p.category_id, 0),
             p.condition,
             p.status_id,
             p.location,
             p.description,
             p.created,
+            p.shipping_option,
+            p.shipping_cost,
+            (SELECT COUNT(*) FROM watchlist w WHERE w.product_id = p.p_id) as watchers,
+            ` + previousPriceColumn + ` as previous_price,
+            p.expires_at,
+            p.publish_at,
+            p.version,
             string_agg(pi.image_path, ',') as image_paths
         FROM product p
         LEFT JOIN product_image pi ON p.p_id = pi.product_id
-        WHERE p.p_id = $1
-        GROUP BY p.p_id, p.u_id, p.name, p.price, p.category_id, p.condition, p.status_id, p.location, p.description, p.created`
+        WHERE p.p_id = $1 AND p.deleted_at IS NULL
+        GROUP BY p.p_id, p.u_id, p.name, p.price, p.category_id, p.condition, p.status_id, p.location, p.description, p.created,
+            p.shipping_option, p.shipping_cost, p.expires_at, p.publish_at, p.version`
 
     err := db.DB.QueryRow(query, productId).Scan(
         &product.ProductID,
@@ -377,9 +736,46 @@ func GetProductById(w http.ResponseWriter, r *http.Request) {
         &product.Location,
         &product.Description,
         &product.Created,
+        &product.ShippingOption,
+        &product.ShippingCost,
+        &product.Watchers,
+        &previousPrice,
+        &expiresAt,
+        &publishAt,
+        &product.Version,
         &imagePathsStr,
     )
+    if err != nil {
+        return product, err
+    }
 
+    product.setPreviousPrice(previousPrice)
+    product.ExpiresAt = nullTimePtr(expiresAt)
+    product.PublishAt = nullTimePtr(publishAt)
+
+    // Parse the comma-separated image paths
+    if imagePathsStr.Valid && imagePathsStr.String != "" {
+        product.Images = strings.Split(imagePathsStr.String, ",")
+    } else {
+        product.Images = []string{}
+    }
+    product.setImageVariants()
+    return product, nil
+}
+
+func GetProductById(w http.ResponseWriter, r *http.Request) {
+    path := r.URL.Path
+    parts := strings.Split(path, "/")
+
+    if len(parts) != 3 || parts[1] != "product" || parts[2] == "" {
+        w.WriteHeader(http.StatusBadRequest)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Invalid product URL"})
+        return
+    }
+
+    productId := parts[2]
+
+    product, err := loadProduct(productId)
     if err != nil {
         if err == sql.ErrNoRows {
             w.WriteHeader(http.StatusNotFound)
@@ -391,13 +787,18 @@ func GetProductById(w http.ResponseWriter, r *http.Request) {
         return
     }
 
-    // Parse the comma-separated image paths
-    if imagePathsStr.Valid && imagePathsStr.String != "" {
-        product.Images = strings.Split(imagePathsStr.String, ",")
-    } else {
-        product.Images = []string{}
+    // Drafts are only visible to their seller, who is not counted as a viewer either
+    userContext, _ := r.Context().Value("userContext").(UserContext)
+    if userContext.UserId != product.UserID {
+        if product.Status == StatusDraft {
+            w.WriteHeader(http.StatusNotFound)
+            json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+            return
+        }
+        recordView(product.ProductID, userContext.UserId)
     }
 
+    w.Header().Set("ETag", productETag(product.Version))
     w.WriteHeader(http.StatusOK)
 
     if err := json.NewEncoder(w).Encode(product); err != nil {
@@ -422,8 +823,13 @@ func GetCategoryProducts(w http.ResponseWriter, r *http.Request) {
                 p.description,
                 p.created,
                 p.u_id,
+                p.shipping_option,
+                p.shipping_cost,
+                (SELECT COUNT(*) FROM watchlist w WHERE w.product_id = p.p_id) as watchers,
+                ` + previousPriceColumn + ` as previous_price,
                 ROW_NUMBER() OVER (PARTITION BY p.category_id ORDER BY p.created DESC) as rn
             FROM product p
+            WHERE p.status_id NOT IN (` + strconv.Itoa(StatusExpired) + `, ` + strconv.Itoa(StatusDraft) + `) AND p.deleted_at IS NULL
         )
         SELECT 
             rp.p_id,
@@ -436,6 +842,10 @@ func GetCategoryProducts(w http.ResponseWriter, r *http.Request) {
             rp.description,
             rp.created,
             rp.u_id,
+            rp.shipping_option,
+            rp.shipping_cost,
+            rp.watchers,
+            rp.previous_price,
             pi.image_path
         FROM ranked_products rp
         LEFT JOIN product_image pi ON rp.p_id = pi.product_id
@@ -454,10 +864,11 @@ func GetCategoryProducts(w http.ResponseWriter, r *http.Request) {
     categoryMap := make(map[int][]ProductResponse)
 
     for rows.Next() {
-        var productID, name, condition, location, description, userID string
-        var price float32
-        var category, status int
+        var productID, name, condition, location, description, userID, shippingOption string
+        var price, shippingCost float32
+        var category, status, watchers int
         var imagePath sql.NullString
+        var previousPrice sql.NullFloat64
         var created time.Time
 
         err := rows.Scan(
@@ -471,6 +882,10 @@ func GetCategoryProducts(w http.ResponseWriter, r *http.Request) {
             &description,
             &created,
             &userID,
+            &shippingOption,
+            &shippingCost,
+            &watchers,
+            &previousPrice,
             &imagePath,
         )
         if err != nil {
@@ -492,8 +907,12 @@ func GetCategoryProducts(w http.ResponseWriter, r *http.Request) {
                 Description: description,
                 Created:     created,
                 UserID:      userID,
+                ShippingOption: shippingOption,
+                ShippingCost:   shippingCost,
+                Watchers:    watchers,
                 Images:      []string{},
             }
+            productMap[productID].setPreviousPrice(previousPrice)
         }
 
         // Add image path if it exists
@@ -510,6 +929,7 @@ func GetCategoryProducts(w http.ResponseWriter, r *http.Request) {
 
     // Group products by category ID
     for _, product := range productMap {
+        product.setImageVariants()
         categoryMap[product.Category] = append(categoryMap[product.Category], *product)
     }
 
@@ -538,16 +958,22 @@ func GetUserProducts(w http.ResponseWriter, r *http.Request) {
             p.p_id,
             p.name,
             p.price,
-            p.category_id,
+            COALESCE(p.category_id, 0),
             p.condition,
             p.status_id,
             p.location,
             p.description,
             p.created,
+            p.shipping_option,
+            p.shipping_cost,
+            (SELECT COUNT(*) FROM watchlist w WHERE w.product_id = p.p_id) as watchers,
+            ` + previousPriceColumn + ` as previous_price,
+            p.expires_at,
+            p.publish_at,
             pi.image_path
         FROM product p
         LEFT JOIN product_image pi ON p.p_id = pi.product_id
-        WHERE p.u_id = $1`
+        WHERE p.u_id = $1 AND p.deleted_at IS NULL`
 
     rows, err := db.DB.Query(query, userId)
     if err != nil {
@@ -560,10 +986,12 @@ func GetUserProducts(w http.ResponseWriter, r *http.Request) {
     productMap := make(map[string]*ProductResponse)
     
     for rows.Next() {
-        var productID, name, condition, location, description string
-        var price float32
-        var category, status int
+        var productID, name, condition, location, description, shippingOption string
+        var price, shippingCost float32
+        var category, status, watchers int
         var imagePath sql.NullString
+        var previousPrice sql.NullFloat64
+        var expiresAt, publishAt sql.NullTime
         var created time.Time
 
         err := rows.Scan(
@@ -576,6 +1004,12 @@ func GetUserProducts(w http.ResponseWriter, r *http.Request) {
             &location,
             &description,
             &created,
+            &shippingOption,
+            &shippingCost,
+            &watchers,
+            &previousPrice,
+            &expiresAt,
+            &publishAt,
             &imagePath,
         )
         if err != nil {
@@ -596,8 +1030,14 @@ func GetUserProducts(w http.ResponseWriter, r *http.Request) {
                 Location:    location,
                 Description: description,
                 Created:     created,
+                ShippingOption: shippingOption,
+                ShippingCost:   shippingCost,
+                Watchers:    watchers,
+                ExpiresAt:   nullTimePtr(expiresAt),
+                PublishAt:   nullTimePtr(publishAt),
                 Images:      []string{},
             }
+            productMap[productID].setPreviousPrice(previousPrice)
         }
 
         // Add image path if it exists
@@ -615,6 +1055,7 @@ func GetUserProducts(w http.ResponseWriter, r *http.Request) {
     // Convert map to slice
     var products []ProductResponse
     for _, product := range productMap {
+        product.setImageVariants()
         products = append(products, *product)
     }
 
@@ -645,22 +1086,16 @@ func DeleteProductById(w http.ResponseWriter, r *http.Request){
 
     var userId = userContext.UserId
 
-    query := `
-        SELECT 
-            p.u_id,
-            string_agg(pi.image_path, ',') as image_paths
-        FROM product p
-        LEFT JOIN product_image pi ON p.p_id = pi.product_id
-        WHERE p.p_id = $1
-        GROUP BY p.u_id`
+    tx, err := db.DB.Begin()
+    if err != nil {
+        w.WriteHeader(http.StatusInternalServerError)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete product"})
+        return
+    }
+    defer tx.Rollback()
 
     var productUserId string
-    var imagePathsString sql.NullString
-
-    err := db.DB.QueryRow(query, productId).Scan(
-        &productUserId,
-        &imagePathsString,
-    )
+    err = tx.QueryRow("SELECT u_id FROM product WHERE p_id = $1 AND deleted_at IS NULL FOR UPDATE", productId).Scan(&productUserId)
 
     if err != nil {
         if err == sql.ErrNoRows {
@@ -679,31 +1114,24 @@ func DeleteProductById(w http.ResponseWriter, r *http.Request){
         return
     }
 
-    // Convert to string array or empty array
-    var imagePaths []string
-    if imagePathsString.Valid && imagePathsString.String != "" {
-        imagePaths = strings.Split(imagePathsString.String, ",")
-    } else {
-        imagePaths = []string{} // Empty array if no images
-    }
-
-    // Delete image files if any exist
-    if len(imagePaths) > 0 {
-        err = DeleteImageFiles(imagePaths)
-        if err != nil {
-            w.WriteHeader(http.StatusInternalServerError)
-            json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete images"})
+    // The product goes to the trash, where it can be restored until the purge job removes it with its images
+    if err := trashProduct(tx, productId); err != nil {
+        if err == ErrProductInUse {
+            w.WriteHeader(http.StatusConflict)
+            json.NewEncoder(w).Encode(map[string]string{"error": "Products with an open order or reservation cannot be deleted"})
             return
         }
+        w.WriteHeader(http.StatusInternalServerError)
+        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete product"})
+        return
     }
 
-    _, err = db.DB.Exec("DELETE FROM product WHERE p_id = $1", productId)
-    if err != nil {
+    if err := tx.Commit(); err != nil {
         w.WriteHeader(http.StatusInternalServerError)
-        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete product from database"})
+        json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete product"})
         return
     }
 
     w.WriteHeader(http.StatusOK)
-    json.NewEncoder(w).Encode(map[string]string{"message": "Product deleted successfully"})
+    json.NewEncoder(w).Encode(map[string]string{"message": "Product moved to the trash"})
 }
\ No newline at end of file
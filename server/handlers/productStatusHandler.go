@@ -6,6 +6,31 @@ import (
 	"net/http"
 )
 
+// Product status ids as seeded in db/tables.sql
+const (
+	StatusActive   = 1
+	StatusSold     = 2
+	StatusReserved = 3
+	StatusExpired  = 4
+	StatusDraft    = 5
+)
+
+func productStatusName(status int) string {
+	switch status {
+	case StatusActive:
+		return "active"
+	case StatusSold:
+		return "sold"
+	case StatusReserved:
+		return "reserved"
+	case StatusExpired:
+		return "expired"
+	case StatusDraft:
+		return "draft"
+	}
+	return "unavailable"
+}
+
 func GetProductStatuses(w http.ResponseWriter, r *http.Request) {
 	query := `SELECT id, name FROM product_status`
 
@@ -0,0 +1,229 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"ibuy-server/db"
+	"ibuy-server/netguard"
+	"ibuy-server/push"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Push sends web push messages, nil disables push
+var Push *push.Sender
+
+type PushSubscriptionRequest struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+	Device string `json:"device"`
+}
+
+type PushSubscription struct {
+	SubscriptionID string    `json:"subscriptionId"`
+	Endpoint       string    `json:"endpoint"`
+	Device         string    `json:"device"`
+	Created        time.Time `json:"created"`
+}
+
+// PushPayload is the JSON the service worker receives
+type PushPayload struct {
+	Type      string `json:"type"`
+	Title     string `json:"title"`
+	Body      string `json:"body"`
+	ProductID string `json:"productId,omitempty"`
+}
+
+// GetVapidPublicKey returns the key browsers need to subscribe to push messages
+func GetVapidPublicKey(w http.ResponseWriter, r *http.Request) {
+	if Push == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Push notifications are disabled"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"publicKey": Push.PublicKey()})
+}
+
+func GetPushSubscriptions(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	rows, err := db.DB.Query(
+		"SELECT s_id, endpoint, device, created FROM push_subscription WHERE u_id = $1 ORDER BY created DESC",
+		userContext.UserId,
+	)
+	if err != nil {
+		log.Printf("Error querying push subscriptions: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get push subscriptions"})
+		return
+	}
+	defer rows.Close()
+
+	subscriptions := []PushSubscription{}
+	for rows.Next() {
+		var subscription PushSubscription
+		var device sql.NullString
+		if err := rows.Scan(&subscription.SubscriptionID, &subscription.Endpoint, &device, &subscription.Created); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get all push subscription info"})
+			return
+		}
+		subscription.Device = device.String
+		subscriptions = append(subscriptions, subscription)
+	}
+
+	if err = rows.Err(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read push subscriptions"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(subscriptions); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+// AddPushSubscription stores a browser subscription. Subscribing an endpoint again,
+// e.g. after logging in as someone else on the same device, moves it to the current user.
+func AddPushSubscription(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	var req PushSubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	defer r.Body.Close()
+
+	// The server posts to the endpoint, so it has to be a public https URL
+	if err := netguard.CheckURL(req.Endpoint); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid push endpoint"})
+		return
+	}
+	if req.Keys.P256dh == "" || req.Keys.Auth == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Subscription keys are required"})
+		return
+	}
+
+	subscription := PushSubscription{Endpoint: req.Endpoint, Device: req.Device}
+	err := db.DB.QueryRow(`
+		INSERT INTO push_subscription (u_id, endpoint, p256dh, auth, device)
+		VALUES ($1, $2, $3, $4, NULLIF($5, ''))
+		ON CONFLICT (endpoint) DO UPDATE SET u_id = $1, p256dh = $3, auth = $4, device = NULLIF($5, '')
+		RETURNING s_id, created`,
+		userContext.UserId, req.Endpoint, req.Keys.P256dh, req.Keys.Auth, req.Device,
+	).Scan(&subscription.SubscriptionID, &subscription.Created)
+	if err != nil {
+		log.Printf("Error saving push subscription: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save push subscription"})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+
+	if err := json.NewEncoder(w).Encode(subscription); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+func DeletePushSubscription(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	subscriptionId := r.PathValue("id")
+	if subscriptionId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid push subscription URL"})
+		return
+	}
+
+	result, err := db.DB.Exec("DELETE FROM push_subscription WHERE s_id = $1 AND u_id = $2", subscriptionId, userContext.UserId)
+	if err != nil {
+		log.Printf("Error deleting push subscription: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete push subscription"})
+		return
+	}
+
+	if count, _ := result.RowsAffected(); count == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Push subscription not found"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Push subscription deleted successfully"})
+}
+
+// sendPush delivers a payload to every device of a user that wants pushes for the event type.
+// Subscriptions the push service reports as gone are removed.
+func sendPush(userId string, payload PushPayload) {
+	if Push == nil || !notificationEnabled(userId, payload.Type, ChannelPush) {
+		return
+	}
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		log.Printf("Error encoding push payload: %v", err)
+		return
+	}
+
+	rows, err := db.DB.Query("SELECT s_id, endpoint, p256dh, auth FROM push_subscription WHERE u_id = $1", userId)
+	if err != nil {
+		log.Printf("Error querying push subscriptions of %s: %v", userId, err)
+		return
+	}
+
+	subscriptions := map[string]push.Subscription{}
+	for rows.Next() {
+		var subscriptionId string
+		var subscription push.Subscription
+		if err := rows.Scan(&subscriptionId, &subscription.Endpoint, &subscription.P256dh, &subscription.Auth); err == nil {
+			subscriptions[subscriptionId] = subscription
+		}
+	}
+	rows.Close()
+
+	for subscriptionId, subscription := range subscriptions {
+		err := Push.Send(subscription, data)
+		if err == push.ErrSubscriptionGone {
+			if _, err := db.DB.Exec("DELETE FROM push_subscription WHERE s_id = $1", subscriptionId); err != nil {
+				log.Printf("Error deleting expired push subscription: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("Error sending push to %s: %v", userId, err)
+		}
+	}
+}
@@ -0,0 +1,306 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"ibuy-server/db"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type NewReview struct {
+	Rating  int    `json:"rating"`
+	Content string `json:"content"`
+}
+
+type ReviewResponseRequest struct {
+	Response string `json:"response"`
+}
+
+type Review struct {
+	ReviewID          string     `json:"reviewId"`
+	TransactionID     string     `json:"transactionId"`
+	ProductID         string     `json:"productId"`
+	ProductTitle      string     `json:"productTitle"`
+	Reviewer          string     `json:"reviewer"`
+	ReviewerFirstName string     `json:"reviewerFirstName"`
+	ReviewerLastName  string     `json:"reviewerLastName"`
+	Reviewee          string     `json:"reviewee"`
+	Rating            int        `json:"rating"`
+	Content           string     `json:"content"`
+	Created           time.Time  `json:"created"`
+	Response          string     `json:"response"`
+	ResponseCreated   *time.Time `json:"responseCreated"`
+}
+
+type UserReviews struct {
+	UserID        string   `json:"userId"`
+	AverageRating float64  `json:"averageRating"`
+	ReviewCount   int      `json:"reviewCount"`
+	Reviews       []Review `json:"reviews"`
+}
+
+// AddReview lets the buyer or the seller of a sold product rate the other party once.
+func AddReview(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+	var userId = userContext.UserId
+
+	productId := r.PathValue("id")
+	if productId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid product URL"})
+		return
+	}
+
+	var newReview NewReview
+	if err := json.NewDecoder(r.Body).Decode(&newReview); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	defer r.Body.Close()
+
+	if newReview.Rating < 1 || newReview.Rating > 5 {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Rating must be between 1 and 5"})
+		return
+	}
+
+	// Only the two parties of a completed sale may review each other
+	var transactionId, seller, buyer string
+	err := db.DB.QueryRow(`
+		SELECT pt.t_id, pt.seller, pt.buyer
+		FROM product_transaction pt
+		WHERE pt.product_id = $1 AND pt.status_id = $2 AND pt.cancelled_at IS NULL
+		AND (pt.seller = $3 OR pt.buyer = $3)`,
+		productId, StatusSold, userId,
+	).Scan(&transactionId, &seller, &buyer)
+
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(map[string]string{"error": "No completed sale found for this product"})
+			return
+		}
+		log.Printf("Error querying transaction: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to add review"})
+		return
+	}
+
+	reviewee := buyer
+	if userId == buyer {
+		reviewee = seller
+	}
+
+	review := Review{
+		TransactionID: transactionId,
+		ProductID:     productId,
+		Reviewer:      userId,
+		Reviewee:      reviewee,
+		Rating:        newReview.Rating,
+		Content:       newReview.Content,
+	}
+
+	err = db.DB.QueryRow(
+		"INSERT INTO review (transaction_id, reviewer, reviewee, rating, content) VALUES ($1, $2, $3, $4, $5) RETURNING r_id, created",
+		transactionId, userId, reviewee, newReview.Rating, newReview.Content,
+	).Scan(&review.ReviewID, &review.Created)
+
+	if err != nil {
+		if strings.Contains(err.Error(), "duplicate key value violates unique constraint") {
+			w.WriteHeader(http.StatusConflict)
+			json.NewEncoder(w).Encode(map[string]string{"error": "You already reviewed this sale"})
+			return
+		}
+		log.Printf("Error saving review: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to add review"})
+		return
+	}
+
+	notifyAsync(reviewee, NotificationReview, fmt.Sprintf("You received a %d star review", newReview.Rating), productId)
+
+	w.WriteHeader(http.StatusCreated)
+
+	if err := json.NewEncoder(w).Encode(review); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+// RespondToReview stores the reviewed user's single public reply to a review.
+func RespondToReview(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	reviewId := r.PathValue("id")
+	if reviewId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid review URL"})
+		return
+	}
+
+	var req ReviewResponseRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || strings.TrimSpace(req.Response) == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	defer r.Body.Close()
+
+	var reviewee string
+	var existingResponse sql.NullString
+	err := db.DB.QueryRow("SELECT reviewee, response FROM review WHERE r_id = $1", reviewId).Scan(&reviewee, &existingResponse)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Review not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to respond to review"})
+		return
+	}
+
+	if reviewee != userContext.UserId {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not Authorized"})
+		return
+	}
+
+	if existingResponse.Valid {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Review already has a response"})
+		return
+	}
+
+	_, err = db.DB.Exec(
+		"UPDATE review SET response = $1, response_created = $2 WHERE r_id = $3 AND response IS NULL",
+		req.Response, time.Now(), reviewId,
+	)
+	if err != nil {
+		log.Printf("Error saving review response: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to respond to review"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Response saved successfully"})
+}
+
+// GetUserReviews returns every review received by a user together with the aggregate score.
+func GetUserReviews(w http.ResponseWriter, r *http.Request) {
+	userId := r.PathValue("id")
+	if userId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid user URL"})
+		return
+	}
+
+	query := `
+		SELECT
+			rv.r_id,
+			rv.transaction_id,
+			pt.product_id,
+			p.name,
+			rv.reviewer,
+			wu.first_name,
+			wu.last_name,
+			rv.reviewee,
+			rv.rating,
+			rv.content,
+			rv.created,
+			rv.response,
+			rv.response_created
+		FROM review rv
+		INNER JOIN product_transaction pt ON rv.transaction_id = pt.t_id
+		INNER JOIN product p ON pt.product_id = p.p_id
+		INNER JOIN web_user wu ON rv.reviewer = wu.u_id
+		WHERE rv.reviewee = $1
+		ORDER BY rv.created DESC`
+
+	rows, err := db.DB.Query(query, userId)
+	if err != nil {
+		log.Printf("Error querying reviews: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get reviews"})
+		return
+	}
+	defer rows.Close()
+
+	userReviews := UserReviews{
+		UserID:  userId,
+		Reviews: []Review{},
+	}
+
+	ratingSum := 0
+	for rows.Next() {
+		var review Review
+		var content, response sql.NullString
+		var responseCreated sql.NullTime
+
+		err := rows.Scan(
+			&review.ReviewID,
+			&review.TransactionID,
+			&review.ProductID,
+			&review.ProductTitle,
+			&review.Reviewer,
+			&review.ReviewerFirstName,
+			&review.ReviewerLastName,
+			&review.Reviewee,
+			&review.Rating,
+			&content,
+			&review.Created,
+			&response,
+			&responseCreated,
+		)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get all review info"})
+			return
+		}
+
+		review.Content = content.String
+		review.Response = response.String
+		if responseCreated.Valid {
+			review.ResponseCreated = &responseCreated.Time
+		}
+
+		ratingSum += review.Rating
+		userReviews.Reviews = append(userReviews.Reviews, review)
+	}
+
+	if err = rows.Err(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read reviews"})
+		return
+	}
+
+	userReviews.ReviewCount = len(userReviews.Reviews)
+	if userReviews.ReviewCount > 0 {
+		userReviews.AverageRating = float64(ratingSum) / float64(userReviews.ReviewCount)
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(userReviews); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
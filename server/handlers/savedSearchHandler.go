@@ -0,0 +1,258 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"ibuy-server/db"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const NotificationSavedSearch = "saved_search_hit"
+
+type SavedSearch struct {
+	SearchID    string       `json:"searchId"`
+	Name        string       `json:"name"`
+	Filter      SearchFilter `json:"filter"`
+	EmailDigest bool         `json:"emailDigest"`
+	Created     time.Time    `json:"created"`
+}
+
+const savedSearchColumns = "s_id, u_id, name, query, category_id, min_price, max_price, condition, location, email_digest, created"
+
+func scanSavedSearch(row rowScanner) (SavedSearch, string, error) {
+	var search SavedSearch
+	var userId string
+	var category sql.NullInt32
+	var minPrice, maxPrice sql.NullFloat64
+	var condition, location sql.NullString
+	err := row.Scan(
+		&search.SearchID,
+		&userId,
+		&search.Name,
+		&search.Filter.Query,
+		&category,
+		&minPrice,
+		&maxPrice,
+		&condition,
+		&location,
+		&search.EmailDigest,
+		&search.Created,
+	)
+	if category.Valid {
+		c := int(category.Int32)
+		search.Filter.Category = &c
+	}
+	if minPrice.Valid {
+		p := float32(minPrice.Float64)
+		search.Filter.MinPrice = &p
+	}
+	if maxPrice.Valid {
+		p := float32(maxPrice.Float64)
+		search.Filter.MaxPrice = &p
+	}
+	search.Filter.Condition = condition.String
+	search.Filter.Location = location.String
+	return search, userId, err
+}
+
+func GetSavedSearches(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	rows, err := db.DB.Query(
+		"SELECT "+savedSearchColumns+" FROM saved_search WHERE u_id = $1 ORDER BY created DESC",
+		userContext.UserId,
+	)
+	if err != nil {
+		log.Printf("Error querying saved searches: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get saved searches"})
+		return
+	}
+	defer rows.Close()
+
+	searches := []SavedSearch{}
+	for rows.Next() {
+		search, _, err := scanSavedSearch(rows)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get all saved search info"})
+			return
+		}
+		searches = append(searches, search)
+	}
+
+	if err = rows.Err(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read saved searches"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(searches); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+func AddSavedSearch(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	var newSearch SavedSearch
+	if err := json.NewDecoder(r.Body).Decode(&newSearch); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid request body"})
+		return
+	}
+	defer r.Body.Close()
+
+	filter := newSearch.Filter
+	filter.Query = strings.TrimSpace(filter.Query)
+	if filter.Query == "" && filter.Category == nil && filter.MinPrice == nil && filter.MaxPrice == nil &&
+		filter.Condition == "" && filter.Location == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "A saved search needs a query or at least one filter"})
+		return
+	}
+	if filter.MinPrice != nil && filter.MaxPrice != nil && *filter.MinPrice > *filter.MaxPrice {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "minPrice cannot be greater than maxPrice"})
+		return
+	}
+
+	name := strings.TrimSpace(newSearch.Name)
+	if name == "" {
+		name = filter.Query
+	}
+	if name == "" {
+		name = "Saved search"
+	}
+
+	search, _, err := scanSavedSearch(db.DB.QueryRow(
+		`INSERT INTO saved_search (u_id, name, query, category_id, min_price, max_price, condition, location, email_digest)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), NULLIF($8, ''), $9)
+		RETURNING `+savedSearchColumns,
+		userContext.UserId, name, filter.Query, filter.Category, filter.MinPrice, filter.MaxPrice,
+		filter.Condition, filter.Location, newSearch.EmailDigest,
+	))
+	if err != nil {
+		log.Printf("Error saving search: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to save search"})
+		return
+	}
+
+	w.WriteHeader(http.StatusCreated)
+
+	if err := json.NewEncoder(w).Encode(search); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+func DeleteSavedSearch(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	searchId := r.PathValue("id")
+	if searchId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid saved search URL"})
+		return
+	}
+
+	result, err := db.DB.Exec("DELETE FROM saved_search WHERE s_id = $1 AND u_id = $2", searchId, userContext.UserId)
+	if err != nil {
+		log.Printf("Error deleting saved search: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to delete saved search"})
+		return
+	}
+
+	if count, _ := result.RowsAffected(); count == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Saved search not found"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Saved search deleted successfully"})
+}
+
+// matchSavedSearches records a hit and notifies the owner of every saved search the new
+// product matches. Cheap filters are applied in SQL, the text query is matched here.
+func matchSavedSearches(product ProductResponse) {
+	rows, err := db.DB.Query(`
+		SELECT `+savedSearchColumns+`
+		FROM saved_search
+		WHERE u_id <> $1
+		AND (category_id IS NULL OR category_id = $2)
+		AND (min_price IS NULL OR min_price <= $3)
+		AND (max_price IS NULL OR max_price >= $3)`,
+		product.UserID, product.Category, product.Price,
+	)
+	if err != nil {
+		log.Printf("Error querying saved searches for %s: %v", product.ProductID, err)
+		return
+	}
+
+	type hit struct {
+		search SavedSearch
+		userId string
+	}
+	var hits []hit
+	for rows.Next() {
+		search, userId, err := scanSavedSearch(rows)
+		if err != nil {
+			log.Printf("Error reading saved search: %v", err)
+			continue
+		}
+		if search.Filter.Matches(product) {
+			hits = append(hits, hit{search, userId})
+		}
+	}
+	rows.Close()
+
+	// A user with several matching searches is only notified once per product
+	notified := map[string]bool{}
+	for _, h := range hits {
+		_, err := db.DB.Exec(
+			"INSERT INTO saved_search_hit (search_id, product_id) VALUES ($1, $2) ON CONFLICT (search_id, product_id) DO NOTHING",
+			h.search.SearchID, product.ProductID,
+		)
+		if err != nil {
+			log.Printf("Error recording saved search hit: %v", err)
+			continue
+		}
+
+		if notified[h.userId] {
+			continue
+		}
+		notified[h.userId] = true
+
+		content := fmt.Sprintf("New listing for \"%s\": %s", h.search.Name, product.Name)
+		if err := notify(h.userId, NotificationSavedSearch, content, product.ProductID); err != nil {
+			log.Printf("Error notifying user %s of saved search hit: %v", h.userId, err)
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"ibuy-server/db"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultSearchLimit = 20
+	maxSearchLimit     = 100
+)
+
+// SearchFilter describes a product search. Query terms must all appear in the
+// name or description, every other filter is optional.
+type SearchFilter struct {
+	Query     string   `json:"query"`
+	Category  *int     `json:"category"`
+	MinPrice  *float32 `json:"minPrice"`
+	MaxPrice  *float32 `json:"maxPrice"`
+	Condition string   `json:"condition"`
+	Location  string   `json:"location"`
+}
+
+func (f SearchFilter) terms() []string {
+	return strings.Fields(strings.ToLower(f.Query))
+}
+
+// Matches reports whether a product satisfies the filter. It applies the same rules
+// as the SQL built by where, for products that are not in the database yet.
+func (f SearchFilter) Matches(product ProductResponse) bool {
+	text := strings.ToLower(product.Name + " " + product.Description)
+	for _, term := range f.terms() {
+		if !strings.Contains(text, term) {
+			return false
+		}
+	}
+
+	if f.Category != nil && *f.Category != product.Category {
+		return false
+	}
+	if f.MinPrice != nil && product.Price < *f.MinPrice {
+		return false
+	}
+	if f.MaxPrice != nil && product.Price > *f.MaxPrice {
+		return false
+	}
+	if f.Condition != "" && !strings.EqualFold(f.Condition, product.Condition) {
+		return false
+	}
+	if f.Location != "" && !strings.Contains(strings.ToLower(product.Location), strings.ToLower(f.Location)) {
+		return false
+	}
+	return true
+}
+
+// escapeLike escapes the LIKE wildcards in user input
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// where builds the SQL condition for the filter on product alias p, appending its arguments to args
+func (f SearchFilter) where(args []any) (string, []any) {
+	conditions := []string{"p.status_id = " + strconv.Itoa(StatusActive), "p.deleted_at IS NULL"}
+
+	for _, term := range f.terms() {
+		args = append(args, "%"+escapeLike(term)+"%")
+		conditions = append(conditions, fmt.Sprintf("(p.name ILIKE $%d OR p.description ILIKE $%d)", len(args), len(args)))
+	}
+	if f.Category != nil {
+		args = append(args, *f.Category)
+		conditions = append(conditions, fmt.Sprintf("p.category_id = $%d", len(args)))
+	}
+	if f.MinPrice != nil {
+		args = append(args, *f.MinPrice)
+		conditions = append(conditions, fmt.Sprintf("p.price >= $%d", len(args)))
+	}
+	if f.MaxPrice != nil {
+		args = append(args, *f.MaxPrice)
+		conditions = append(conditions, fmt.Sprintf("p.price <= $%d", len(args)))
+	}
+	if f.Condition != "" {
+		args = append(args, f.Condition)
+		conditions = append(conditions, fmt.Sprintf("LOWER(p.condition) = LOWER($%d)", len(args)))
+	}
+	if f.Location != "" {
+		args = append(args, "%"+escapeLike(f.Location)+"%")
+		conditions = append(conditions, fmt.Sprintf("p.location ILIKE $%d", len(args)))
+	}
+
+	return strings.Join(conditions, " AND "), args
+}
+
+// parseSearchFilter reads a SearchFilter from URL query parameters
+func parseSearchFilter(r *http.Request) (SearchFilter, error) {
+	values := r.URL.Query()
+	filter := SearchFilter{
+		Query:     values.Get("q"),
+		Condition: values.Get("condition"),
+		Location:  values.Get("location"),
+	}
+
+	if category := values.Get("category"); category != "" {
+		c, err := strconv.Atoi(category)
+		if err != nil {
+			return filter, fmt.Errorf("invalid category value")
+		}
+		filter.Category = &c
+	}
+	if minPrice := values.Get("minPrice"); minPrice != "" {
+		p, err := strconv.ParseFloat(minPrice, 32)
+		if err != nil {
+			return filter, fmt.Errorf("invalid minPrice value")
+		}
+		price := float32(p)
+		filter.MinPrice = &price
+	}
+	if maxPrice := values.Get("maxPrice"); maxPrice != "" {
+		p, err := strconv.ParseFloat(maxPrice, 32)
+		if err != nil {
+			return filter, fmt.Errorf("invalid maxPrice value")
+		}
+		price := float32(p)
+		filter.MaxPrice = &price
+	}
+	return filter, nil
+}
+
+// SearchProducts returns active products matching the query parameters, newest first
+func SearchProducts(w http.ResponseWriter, r *http.Request) {
+	filter, err := parseSearchFilter(r)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+		return
+	}
+
+	limit := defaultSearchLimit
+	if l, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && l > 0 {
+		limit = min(l, maxSearchLimit)
+	}
+	offset := 0
+	if o, err := strconv.Atoi(r.URL.Query().Get("offset")); err == nil && o > 0 {
+		offset = o
+	}
+
+	where, args := filter.where(nil)
+	args = append(args, limit, offset)
+
+	query := `
+		SELECT
+			p.p_id,
+			p.u_id,
+			p.name,
+			p.price,
+			p.category_id,
+			p.condition,
+			p.status_id,
+			p.location,
+			p.description,
+			p.created,
+			p.shipping_option,
+			p.shipping_cost,
+			(SELECT COUNT(*) FROM watchlist pw WHERE pw.product_id = p.p_id) AS watchers,
+			` + previousPriceColumn + ` AS previous_price,
+			(SELECT string_agg(pi.image_path, ',') FROM product_image pi WHERE pi.product_id = p.p_id) AS image_paths
+		FROM product p
+		WHERE ` + where + fmt.Sprintf(`
+		ORDER BY p.created DESC
+		LIMIT $%d OFFSET $%d`, len(args)-1, len(args))
+
+	rows, err := db.DB.Query(query, args...)
+	if err != nil {
+		log.Printf("Error searching products: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to search products"})
+		return
+	}
+	defer rows.Close()
+
+	products := []ProductResponse{}
+	for rows.Next() {
+		var product ProductResponse
+		var imagePathsStr sql.NullString
+		var previousPrice sql.NullFloat64
+
+		err := rows.Scan(
+			&product.ProductID,
+			&product.UserID,
+			&product.Name,
+			&product.Price,
+			&product.Category,
+			&product.Condition,
+			&product.Status,
+			&product.Location,
+			&product.Description,
+			&product.Created,
+			&product.ShippingOption,
+			&product.ShippingCost,
+			&product.Watchers,
+			&previousPrice,
+			&imagePathsStr,
+		)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get all product info"})
+			return
+		}
+
+		product.setPreviousPrice(previousPrice)
+
+		if imagePathsStr.Valid && imagePathsStr.String != "" {
+			product.Images = strings.Split(imagePathsStr.String, ",")
+		} else {
+			product.Images = []string{}
+		}
+
+		product.setImageVariants()
+		products = append(products, product)
+	}
+
+	if err = rows.Err(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read products"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(products); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
@@ -0,0 +1,32 @@
+package handlers
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestConditionFilterParity checks that the condition is compared as a whole, ignoring
+// case, both in SQL and in Matches, so wildcards in it match nothing special
+func TestConditionFilterParity(t *testing.T) {
+	tests := []struct {
+		filter, condition string
+		match             bool
+	}{
+		{"new", "new", true},
+		{"NEW", "New", true},
+		{"%", "new", false},
+		{"n_w", "new", false},
+		{"ne", "new", false},
+	}
+	for _, tt := range tests {
+		filter := SearchFilter{Condition: tt.filter}
+		if got := filter.Matches(ProductResponse{Condition: tt.condition}); got != tt.match {
+			t.Errorf("condition %q matches %q = %v, want %v", tt.filter, tt.condition, got, tt.match)
+		}
+
+		where, args := filter.where(nil)
+		if !strings.Contains(where, "LOWER(p.condition) = LOWER($1)") || len(args) != 1 || args[0] != tt.filter {
+			t.Errorf("condition %q: SQL %q with %v, want an exact case-insensitive comparison", tt.filter, where, args)
+		}
+	}
+}
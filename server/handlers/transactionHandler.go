@@ -0,0 +1,331 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"ibuy-server/db"
+	"log"
+	"net/http"
+	"time"
+)
+
+type Transaction struct {
+	TransactionID   string     `json:"transactionId"`
+	ProductID       string     `json:"productId"`
+	ProductTitle    string     `json:"productTitle"`
+	ProductImage    string     `json:"productImage"`
+	Seller          string     `json:"seller"`
+	SellerFirstName string     `json:"sellerFirstName"`
+	SellerLastName  string     `json:"sellerLastName"`
+	Buyer           string     `json:"buyer"`
+	BuyerFirstName  string     `json:"buyerFirstName"`
+	BuyerLastName   string     `json:"buyerLastName"`
+	Price           float32    `json:"price"`
+	Status          int        `json:"status"`
+	Created         time.Time  `json:"created"`
+	Updated         time.Time  `json:"updated"`
+	ReservedAt      *time.Time `json:"reservedAt"`
+	SoldAt          *time.Time `json:"soldAt"`
+	CancelledAt     *time.Time `json:"cancelledAt"`
+}
+
+type InterestedBuyer struct {
+	UserID      string    `json:"userId"`
+	FirstName   string    `json:"firstName"`
+	LastName    string    `json:"lastName"`
+	LastMessage time.Time `json:"lastMessage"`
+}
+
+var (
+	ErrNotProductOwner  = errors.New("user does not own product")
+	ErrBuyerNotEligible = errors.New("buyer has not messaged about product")
+)
+
+// recordTransaction links a product to the buyer it was reserved for or sold to.
+// The buyer has to be one of the users who messaged the seller about the product.
+func recordTransaction(tx *sql.Tx, productId, sellerId, buyerId string, statusId int, price float32) (string, error) {
+	var eligible bool
+	err := tx.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM message WHERE product_id = $1 AND sender = $2 AND receiver = $3)",
+		productId, buyerId, sellerId,
+	).Scan(&eligible)
+	if err != nil {
+		return "", err
+	}
+	if !eligible {
+		return "", ErrBuyerNotEligible
+	}
+
+	return recordTransactionTx(tx, productId, sellerId, buyerId, statusId, price)
+}
+
+// recordTransactionTx does the work of recordTransaction without checking the buyer.
+// An open transaction with the same buyer is moved forward, one with a different
+// buyer is cancelled and replaced.
+func recordTransactionTx(tx *sql.Tx, productId, sellerId, buyerId string, statusId int, price float32) (string, error) {
+	var ownerId string
+	err := tx.QueryRow("SELECT u_id FROM product WHERE p_id = $1 FOR UPDATE", productId).Scan(&ownerId)
+	if err != nil {
+		return "", err
+	}
+	if ownerId != sellerId {
+		return "", ErrNotProductOwner
+	}
+
+	now := time.Now()
+	var transactionId, openBuyer string
+	err = tx.QueryRow(
+		"SELECT t_id, buyer FROM product_transaction WHERE product_id = $1 AND cancelled_at IS NULL",
+		productId,
+	).Scan(&transactionId, &openBuyer)
+
+	if err != nil && err != sql.ErrNoRows {
+		return "", err
+	}
+
+	if err == nil && openBuyer != buyerId {
+		_, err = tx.Exec("UPDATE product_transaction SET cancelled_at = $1, updated = $1 WHERE t_id = $2", now, transactionId)
+		if err != nil {
+			return "", err
+		}
+		transactionId = ""
+	}
+
+	var reservedAt, soldAt sql.NullTime
+	if statusId == StatusReserved {
+		reservedAt = sql.NullTime{Time: now, Valid: true}
+	} else {
+		soldAt = sql.NullTime{Time: now, Valid: true}
+	}
+
+	if transactionId == "" {
+		err = tx.QueryRow(`
+			INSERT INTO product_transaction (product_id, seller, buyer, price, status_id, created, updated, reserved_at, sold_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $6, $7, $8) RETURNING t_id`,
+			productId, sellerId, buyerId, price, statusId, now, reservedAt, soldAt,
+		).Scan(&transactionId)
+	} else {
+		_, err = tx.Exec(`
+			UPDATE product_transaction
+			SET price = $1, status_id = $2, updated = $3,
+				reserved_at = COALESCE(reserved_at, $4), sold_at = COALESCE(sold_at, $5)
+			WHERE t_id = $6`,
+			price, statusId, now, reservedAt, soldAt, transactionId,
+		)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	return transactionId, nil
+}
+
+// cancelOpenTransactionTx releases a product's buyer when it is put back on sale.
+func cancelOpenTransactionTx(tx *sql.Tx, productId, sellerId string) error {
+	now := time.Now()
+	_, err := tx.Exec(
+		"UPDATE product_transaction SET cancelled_at = $1, updated = $1 WHERE product_id = $2 AND seller = $3 AND cancelled_at IS NULL",
+		now, productId, sellerId,
+	)
+	return err
+}
+
+// GetInterestedBuyers lists the users who messaged the owner about a product,
+// i.e. the users a product can be reserved for or sold to.
+func GetInterestedBuyers(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	productId := r.PathValue("id")
+	if productId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid product URL"})
+		return
+	}
+
+	var ownerId string
+	err := db.DB.QueryRow("SELECT u_id FROM product WHERE p_id = $1 AND deleted_at IS NULL", productId).Scan(&ownerId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get buyers"})
+		return
+	}
+
+	if ownerId != userContext.UserId {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Not Authorized"})
+		return
+	}
+
+	query := `
+		SELECT wu.u_id, wu.first_name, wu.last_name, MAX(m.created) AS last_message
+		FROM message m
+		INNER JOIN web_user wu ON m.sender = wu.u_id
+		WHERE m.product_id = $1 AND m.receiver = $2
+		GROUP BY wu.u_id, wu.first_name, wu.last_name
+		ORDER BY last_message DESC`
+
+	rows, err := db.DB.Query(query, productId, ownerId)
+	if err != nil {
+		log.Printf("Error querying buyers: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get buyers"})
+		return
+	}
+	defer rows.Close()
+
+	buyers := []InterestedBuyer{}
+	for rows.Next() {
+		var buyer InterestedBuyer
+		if err := rows.Scan(&buyer.UserID, &buyer.FirstName, &buyer.LastName, &buyer.LastMessage); err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get all buyer info"})
+			return
+		}
+		buyers = append(buyers, buyer)
+	}
+
+	if err = rows.Err(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read buyers"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(buyers); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+func GetPurchases(w http.ResponseWriter, r *http.Request) {
+	getTransactionHistory(w, r, "buyer")
+}
+
+func GetSales(w http.ResponseWriter, r *http.Request) {
+	getTransactionHistory(w, r, "seller")
+}
+
+// getTransactionHistory writes the current user's transactions where they are the given party.
+// party is always one of the fixed column names "buyer" or "seller".
+func getTransactionHistory(w http.ResponseWriter, r *http.Request, party string) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	query := `
+		SELECT
+			pt.t_id,
+			pt.product_id,
+			p.name,
+			pi.image_path,
+			pt.seller,
+			s.first_name,
+			s.last_name,
+			pt.buyer,
+			b.first_name,
+			b.last_name,
+			pt.price,
+			pt.status_id,
+			pt.created,
+			pt.updated,
+			pt.reserved_at,
+			pt.sold_at,
+			pt.cancelled_at
+		FROM product_transaction pt
+		INNER JOIN product p ON pt.product_id = p.p_id
+		INNER JOIN web_user s ON pt.seller = s.u_id
+		INNER JOIN web_user b ON pt.buyer = b.u_id
+		LEFT JOIN LATERAL (
+			SELECT image_path
+			FROM product_image
+			WHERE product_id = pt.product_id
+			ORDER BY uploaded_at ASC
+			LIMIT 1
+		) pi ON true
+		WHERE pt.` + party + ` = $1
+		ORDER BY pt.updated DESC`
+
+	rows, err := db.DB.Query(query, userContext.UserId)
+	if err != nil {
+		log.Printf("Error querying transactions: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get transactions"})
+		return
+	}
+	defer rows.Close()
+
+	transactions := []Transaction{}
+	for rows.Next() {
+		var t Transaction
+		var productImage sql.NullString
+		var reservedAt, soldAt, cancelledAt sql.NullTime
+
+		err := rows.Scan(
+			&t.TransactionID,
+			&t.ProductID,
+			&t.ProductTitle,
+			&productImage,
+			&t.Seller,
+			&t.SellerFirstName,
+			&t.SellerLastName,
+			&t.Buyer,
+			&t.BuyerFirstName,
+			&t.BuyerLastName,
+			&t.Price,
+			&t.Status,
+			&t.Created,
+			&t.Updated,
+			&reservedAt,
+			&soldAt,
+			&cancelledAt,
+		)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get all transaction info"})
+			return
+		}
+
+		t.ProductImage = productImage.String
+		if reservedAt.Valid {
+			t.ReservedAt = &reservedAt.Time
+		}
+		if soldAt.Valid {
+			t.SoldAt = &soldAt.Time
+		}
+		if cancelledAt.Valid {
+			t.CancelledAt = &cancelledAt.Time
+		}
+
+		transactions = append(transactions, t)
+	}
+
+	if err = rows.Err(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read transactions"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(transactions); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
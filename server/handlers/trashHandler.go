@@ -0,0 +1,324 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"ibuy-server/db"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type TrashConfig struct {
+	RetentionPeriod time.Duration // how long a deleted product can be restored
+	CheckInterval   time.Duration // how often the purge job looks for products past retention
+}
+
+// NewTrashConfig creates a default trash configuration
+func NewTrashConfig() *TrashConfig {
+	return &TrashConfig{
+		RetentionPeriod: 30 * 24 * time.Hour,
+		CheckInterval:   time.Hour,
+	}
+}
+
+var Trash = NewTrashConfig()
+
+// ErrProductInUse is returned for products a buyer is waiting for, which cannot be deleted
+var ErrProductInUse = errors.New("product has an open order or reservation")
+
+// trashProduct moves a product, locked by the caller, to the trash. Products with an open
+// order or reservation stay where they are, pending offers on the others are declined.
+func trashProduct(tx *sql.Tx, productId string) error {
+	openOrder, err := productHasOpenOrder(tx, productId)
+	if err != nil {
+		return err
+	}
+	var reserved bool
+	err = tx.QueryRow(
+		"SELECT EXISTS (SELECT 1 FROM product_transaction WHERE product_id = $1 AND status_id = $2 AND cancelled_at IS NULL)",
+		productId, StatusReserved,
+	).Scan(&reserved)
+	if err != nil {
+		return err
+	}
+	if openOrder || reserved {
+		return ErrProductInUse
+	}
+
+	now := time.Now()
+	_, err = tx.Exec(
+		"UPDATE offer SET status_id = $1, responded_at = $2 WHERE product_id = $3 AND status_id = $4",
+		OfferDeclined, now, productId, OfferPending,
+	)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE product SET deleted_at = $1 WHERE p_id = $2 AND deleted_at IS NULL", now, productId)
+	return err
+}
+
+// productReferenced is true for products that conversations, offers, transactions or orders
+// point to. Purging keeps their rows, without images, so that history stays readable.
+const productReferenced = `(
+	EXISTS (SELECT 1 FROM message m WHERE m.product_id = p.p_id)
+	OR EXISTS (SELECT 1 FROM offer o WHERE o.product_id = p.p_id)
+	OR EXISTS (SELECT 1 FROM product_transaction t WHERE t.product_id = p.p_id)
+	OR EXISTS (SELECT 1 FROM product_order po WHERE po.product_id = p.p_id))`
+
+type TrashedProduct struct {
+	ProductResponse
+	DeletedAt    time.Time `json:"deletedAt"`
+	RestoreUntil time.Time `json:"restoreUntil"`
+}
+
+// GetTrash lists the current user's deleted products that can still be restored
+func GetTrash(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	rows, err := db.DB.Query(`
+		SELECT
+			p.p_id,
+			p.u_id,
+			p.name,
+			p.price,
+			COALESCE(p.category_id, 0),
+			p.condition,
+			p.status_id,
+			p.location,
+			p.description,
+			p.created,
+			p.shipping_option,
+			p.shipping_cost,
+			p.version,
+			p.deleted_at,
+			(SELECT string_agg(pi.image_path, ',') FROM product_image pi WHERE pi.product_id = p.p_id) AS image_paths
+		FROM product p
+		WHERE p.u_id = $1 AND p.deleted_at > $2
+		ORDER BY p.deleted_at DESC`,
+		userContext.UserId, time.Now().Add(-Trash.RetentionPeriod),
+	)
+	if err != nil {
+		log.Printf("Error querying trash: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get deleted products"})
+		return
+	}
+	defer rows.Close()
+
+	products := []TrashedProduct{}
+	for rows.Next() {
+		var product TrashedProduct
+		var imagePathsStr sql.NullString
+		err := rows.Scan(
+			&product.ProductID,
+			&product.UserID,
+			&product.Name,
+			&product.Price,
+			&product.Category,
+			&product.Condition,
+			&product.Status,
+			&product.Location,
+			&product.Description,
+			&product.Created,
+			&product.ShippingOption,
+			&product.ShippingCost,
+			&product.Version,
+			&product.DeletedAt,
+			&imagePathsStr,
+		)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get all product info"})
+			return
+		}
+
+		product.RestoreUntil = product.DeletedAt.Add(Trash.RetentionPeriod)
+		if imagePathsStr.Valid && imagePathsStr.String != "" {
+			product.Images = strings.Split(imagePathsStr.String, ",")
+		} else {
+			product.Images = []string{}
+		}
+		product.setImageVariants()
+		products = append(products, product)
+	}
+
+	if err = rows.Err(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read deleted products"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(products); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+// RestoreProduct takes a product out of the trash while it is within the retention period
+func RestoreProduct(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	productId := r.PathValue("id")
+	if productId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid product URL"})
+		return
+	}
+
+	var deletedAt time.Time
+	err := db.DB.QueryRow(
+		"SELECT deleted_at FROM product WHERE p_id = $1 AND u_id = $2 AND deleted_at IS NOT NULL",
+		productId, userContext.UserId,
+	).Scan(&deletedAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Deleted product not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to restore product"})
+		return
+	}
+
+	if time.Since(deletedAt) > Trash.RetentionPeriod {
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Product can no longer be restored"})
+		return
+	}
+
+	// Checked again in the update, the purge job may have got to the product meanwhile
+	result, err := db.DB.Exec(
+		"UPDATE product SET deleted_at = NULL WHERE p_id = $1 AND deleted_at > $2",
+		productId, time.Now().Add(-Trash.RetentionPeriod),
+	)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to restore product"})
+		return
+	}
+	if restored, err := result.RowsAffected(); err != nil || restored == 0 {
+		w.WriteHeader(http.StatusGone)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Product can no longer be restored"})
+		return
+	}
+
+	product, err := loadProduct(productId)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get product"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(product); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
+
+// RunTrashPurger periodically purges products that stayed in the trash past the retention period
+func RunTrashPurger(config *TrashConfig) {
+	ticker := time.NewTicker(config.CheckInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		purgeTrash(config.RetentionPeriod)
+	}
+}
+
+// purgeTrash removes the images of products deleted longer than retention ago, and the
+// products themselves unless other records still refer to them
+func purgeTrash(retention time.Duration) {
+	cutoff := time.Now().Add(-retention)
+	rows, err := db.DB.Query(`
+		SELECT p.p_id
+		FROM product p
+		WHERE p.deleted_at <= $1
+		AND (EXISTS (SELECT 1 FROM product_image pi WHERE pi.product_id = p.p_id) OR NOT `+productReferenced+`)`,
+		cutoff,
+	)
+	if err != nil {
+		log.Printf("Error querying trash to purge: %v", err)
+		return
+	}
+
+	var productIds []string
+	for rows.Next() {
+		var productId string
+		if err := rows.Scan(&productId); err == nil {
+			productIds = append(productIds, productId)
+		}
+	}
+	rows.Close()
+
+	for _, productId := range productIds {
+		if err := purgeProduct(productId, cutoff); err != nil {
+			log.Printf("Error purging product %s: %v", productId, err)
+		}
+	}
+}
+
+// purgeProduct deletes a trashed product's image rows, and its own row when nothing refers
+// to it, and removes the image files once that is committed
+func purgeProduct(productId string, cutoff time.Time) error {
+	tx, err := db.DB.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Lock the product and make sure it was not restored since it was selected
+	var locked string
+	err = tx.QueryRow("SELECT p_id FROM product WHERE p_id = $1 AND deleted_at <= $2 FOR UPDATE", productId, cutoff).Scan(&locked)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var imagePaths []string
+	rows, err := tx.Query("DELETE FROM product_image WHERE product_id = $1 RETURNING image_path", productId)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var imagePath string
+		if err := rows.Scan(&imagePath); err == nil {
+			imagePaths = append(imagePaths, imagePath)
+		}
+	}
+	rows.Close()
+
+	_, err = tx.Exec("DELETE FROM product p WHERE p.p_id = $1 AND p.deleted_at IS NOT NULL AND NOT "+productReferenced, productId)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	discardImageFiles(imagePaths)
+	return nil
+}
@@ -0,0 +1,183 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"ibuy-server/db"
+	"log"
+	"net/http"
+	"strings"
+)
+
+func AddToWatchlist(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	productId := r.PathValue("productId")
+	if productId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid product URL"})
+		return
+	}
+
+	// Drafts are invisible to everyone but their seller
+	var ownerId string
+	err := db.DB.QueryRow("SELECT u_id FROM product WHERE p_id = $1 AND status_id <> $2 AND deleted_at IS NULL", productId, StatusDraft).Scan(&ownerId)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			w.WriteHeader(http.StatusNotFound)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Product not found"})
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to watch product"})
+		return
+	}
+
+	if ownerId == userContext.UserId {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "You cannot watch your own product"})
+		return
+	}
+
+	_, err = db.DB.Exec(
+		"INSERT INTO watchlist (u_id, product_id) VALUES ($1, $2) ON CONFLICT (u_id, product_id) DO NOTHING",
+		userContext.UserId, productId,
+	)
+	if err != nil {
+		log.Printf("Error watching product: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to watch product"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Product added to watchlist"})
+}
+
+func RemoveFromWatchlist(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	productId := r.PathValue("productId")
+	if productId == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Invalid product URL"})
+		return
+	}
+
+	_, err := db.DB.Exec("DELETE FROM watchlist WHERE u_id = $1 AND product_id = $2", userContext.UserId, productId)
+	if err != nil {
+		log.Printf("Error unwatching product: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to remove product from watchlist"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"message": "Product removed from watchlist"})
+}
+
+// GetWatchlist returns the products the current user watches, most recently watched first
+func GetWatchlist(w http.ResponseWriter, r *http.Request) {
+	userContext, ok := r.Context().Value("userContext").(UserContext)
+	if !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "No user context found"})
+		return
+	}
+
+	query := `
+		SELECT
+			p.p_id,
+			p.u_id,
+			p.name,
+			p.price,
+			p.category_id,
+			p.condition,
+			p.status_id,
+			p.location,
+			p.description,
+			p.created,
+			p.shipping_option,
+			p.shipping_cost,
+			(SELECT COUNT(*) FROM watchlist pw WHERE pw.product_id = p.p_id) AS watchers,
+			` + previousPriceColumn + ` AS previous_price,
+			(SELECT string_agg(pi.image_path, ',') FROM product_image pi WHERE pi.product_id = p.p_id) AS image_paths
+		FROM watchlist wl
+		INNER JOIN product p ON wl.product_id = p.p_id
+		WHERE wl.u_id = $1 AND p.deleted_at IS NULL
+		ORDER BY wl.created DESC`
+
+	rows, err := db.DB.Query(query, userContext.UserId)
+	if err != nil {
+		log.Printf("Error querying watchlist: %v", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get watchlist"})
+		return
+	}
+	defer rows.Close()
+
+	products := []ProductResponse{}
+	for rows.Next() {
+		var product ProductResponse
+		var imagePathsStr sql.NullString
+		var previousPrice sql.NullFloat64
+
+		err := rows.Scan(
+			&product.ProductID,
+			&product.UserID,
+			&product.Name,
+			&product.Price,
+			&product.Category,
+			&product.Condition,
+			&product.Status,
+			&product.Location,
+			&product.Description,
+			&product.Created,
+			&product.ShippingOption,
+			&product.ShippingCost,
+			&product.Watchers,
+			&previousPrice,
+			&imagePathsStr,
+		)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			json.NewEncoder(w).Encode(map[string]string{"error": "Failed to get all product info"})
+			return
+		}
+
+		product.setPreviousPrice(previousPrice)
+
+		if imagePathsStr.Valid && imagePathsStr.String != "" {
+			product.Images = strings.Split(imagePathsStr.String, ",")
+		} else {
+			product.Images = []string{}
+		}
+
+		product.setImageVariants()
+		products = append(products, product)
+	}
+
+	if err = rows.Err(); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to read watchlist"})
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+
+	if err := json.NewEncoder(w).Encode(products); err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		json.NewEncoder(w).Encode(map[string]string{"error": "Failed to encode response"})
+		return
+	}
+}
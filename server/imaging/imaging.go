@@ -0,0 +1,163 @@
+// Package imaging decodes uploaded images and renders the resized variants served to clients.
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/draw"
+	_ "image/gif"
+	"image/jpeg"
+	"image/png"
+	"io"
+)
+
+// Variant is a resized rendition of an uploaded image
+type Variant struct {
+	Name    string
+	MaxSize int // longest side in pixels, smaller images are not enlarged
+}
+
+var (
+	Thumbnail = Variant{Name: "thumbnail", MaxSize: 200}
+	Card      = Variant{Name: "card", MaxSize: 480}
+	Full      = Variant{Name: "full", MaxSize: 1600}
+)
+
+// Variants are rendered for every upload
+var Variants = []Variant{Thumbnail, Card, Full}
+
+const jpegQuality = 85
+
+var ErrUnsupportedFormat = errors.New("unsupported image format, expected JPEG, PNG or GIF")
+
+// Image is a decoded upload
+type Image struct {
+	Format      string // "jpeg", "png" or "gif"
+	orientation int
+	upright     *image.RGBA
+	data        []byte
+}
+
+// Inspect reads the format and size of an image from its header without decoding it
+func Inspect(data []byte) (image.Config, string, error) {
+	config, format, err := image.DecodeConfig(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		return config, format, ErrUnsupportedFormat
+	}
+	return config, format, err
+}
+
+// Decode decodes an upload and turns it upright according to its EXIF orientation
+func Decode(data []byte) (*Image, error) {
+	decoded, format, err := image.Decode(bytes.NewReader(data))
+	if errors.Is(err, image.ErrFormat) {
+		return nil, ErrUnsupportedFormat
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	img := &Image{Format: format, orientation: 1, data: data}
+	if format == "jpeg" {
+		img.orientation = jpegOrientation(data)
+	}
+	img.upright = orient(toRGBA(decoded), img.orientation)
+	return img, nil
+}
+
+// Bounds returns the size of the upright image
+func (i *Image) Bounds() image.Rectangle {
+	return i.upright.Bounds()
+}
+
+// Original returns the upload with metadata such as camera details and GPS position
+// removed. The orientation is kept so the original still displays upright. Files the
+// decoder accepted but whose structure cannot be parsed are encoded again from the
+// upright image, so their metadata is never passed on.
+func (i *Image) Original() ([]byte, error) {
+	var buf bytes.Buffer
+	switch i.Format {
+	case "jpeg":
+		if stripped, ok := stripJPEGMetadata(i.data, i.orientation); ok {
+			return stripped, nil
+		}
+		err := jpeg.Encode(&buf, i.upright, &jpeg.Options{Quality: jpegQuality})
+		return buf.Bytes(), err
+	case "png":
+		if stripped, ok := stripPNGMetadata(i.data); ok {
+			return stripped, nil
+		}
+		err := png.Encode(&buf, i.upright)
+		return buf.Bytes(), err
+	}
+	return i.data, nil
+}
+
+// Render writes the variant as a JPEG. Transparent areas become white.
+func (i *Image) Render(w io.Writer, v Variant) error {
+	return jpeg.Encode(w, flatten(resize(i.upright, v.MaxSize)), &jpeg.Options{Quality: jpegQuality})
+}
+
+func toRGBA(src image.Image) *image.RGBA {
+	b := src.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, b.Min, draw.Src)
+	return dst
+}
+
+// resize scales the image down to fit maxSize by averaging the source pixels each
+// target pixel covers
+func resize(src *image.RGBA, maxSize int) *image.RGBA {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	if w <= maxSize && h <= maxSize {
+		return src
+	}
+
+	dw, dh := maxSize, maxSize
+	if w >= h {
+		dh = max(1, h*maxSize/w)
+	} else {
+		dw = max(1, w*maxSize/h)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		sy0, sy1 := y*h/dh, (y+1)*h/dh
+		for x := 0; x < dw; x++ {
+			sx0, sx1 := x*w/dw, (x+1)*w/dw
+
+			var sum [4]int
+			for sy := sy0; sy < sy1; sy++ {
+				row := src.Pix[sy*src.Stride+sx0*4 : sy*src.Stride+sx1*4]
+				for p := 0; p < len(row); p += 4 {
+					sum[0] += int(row[p])
+					sum[1] += int(row[p+1])
+					sum[2] += int(row[p+2])
+					sum[3] += int(row[p+3])
+				}
+			}
+
+			n := (sy1 - sy0) * (sx1 - sx0)
+			out := dst.Pix[y*dst.Stride+x*4:]
+			for c := range sum {
+				out[c] = uint8(sum[c] / n)
+			}
+		}
+	}
+	return dst
+}
+
+// flatten composites the image onto a white background, JPEG has no alpha channel
+func flatten(src *image.RGBA) *image.RGBA {
+	dst := image.NewRGBA(src.Bounds())
+	for p := 0; p < len(src.Pix); p += 4 {
+		// Pixels are alpha-premultiplied, so adding the uncovered part of white is enough
+		alpha := src.Pix[p+3]
+		dst.Pix[p] = src.Pix[p] + 255 - alpha
+		dst.Pix[p+1] = src.Pix[p+1] + 255 - alpha
+		dst.Pix[p+2] = src.Pix[p+2] + 255 - alpha
+		dst.Pix[p+3] = 255
+	}
+	return dst
+}
@@ -0,0 +1,149 @@
+package imaging
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"testing"
+)
+
+func solid(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for p := 0; p < len(img.Pix); p += 4 {
+		img.Pix[p], img.Pix[p+1], img.Pix[p+2], img.Pix[p+3] = 0x80, 0x40, 0x20, 0xFF
+	}
+	return img
+}
+
+func encodeJPEG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, nil); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func encodePNG(t *testing.T, img image.Image) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestResizeKeepsAspectRatio(t *testing.T) {
+	tests := []struct {
+		w, h, maxSize int
+		dw, dh        int
+	}{
+		{1600, 1200, 200, 200, 150},
+		{1200, 1600, 200, 150, 200},
+		{1000, 1000, 480, 480, 480},
+		{1920, 1080, 480, 480, 270},
+		{4000, 10, 200, 200, 1},
+		{10, 4000, 200, 1, 200},
+		{150, 100, 200, 150, 100}, // not enlarged
+		{200, 200, 200, 200, 200},
+	}
+	for _, tt := range tests {
+		got := resize(solid(tt.w, tt.h), tt.maxSize).Bounds()
+		if got.Dx() != tt.dw || got.Dy() != tt.dh {
+			t.Errorf("resize(%dx%d, %d) = %dx%d, want %dx%d", tt.w, tt.h, tt.maxSize, got.Dx(), got.Dy(), tt.dw, tt.dh)
+		}
+	}
+}
+
+func TestResizeAveragesPixels(t *testing.T) {
+	src := solid(400, 300)
+	dst := resize(src, 200)
+	if got := dst.RGBAAt(100, 75); got != (color.RGBA{0x80, 0x40, 0x20, 0xFF}) {
+		t.Errorf("resized pixel = %v, want the source colour", got)
+	}
+}
+
+func TestRenderFitsVariant(t *testing.T) {
+	img, err := Decode(encodePNG(t, solid(900, 600)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, variant := range Variants {
+		var buf bytes.Buffer
+		if err := img.Render(&buf, variant); err != nil {
+			t.Fatalf("Render(%s): %v", variant.Name, err)
+		}
+		config, format, err := Inspect(buf.Bytes())
+		if err != nil {
+			t.Fatalf("Inspect(%s): %v", variant.Name, err)
+		}
+		want := min(variant.MaxSize, 900)
+		if format != "jpeg" || config.Width != want || config.Height != want*2/3 {
+			t.Errorf("%s rendered as %s %dx%d, want jpeg %dx%d", variant.Name, format, config.Width, config.Height, want, want*2/3)
+		}
+	}
+}
+
+func TestDecodeRejectsUnsupportedFormat(t *testing.T) {
+	if _, err := Decode([]byte("GIF87 is not what this is")); err != ErrUnsupportedFormat {
+		t.Errorf("Decode(text) = %v, want ErrUnsupportedFormat", err)
+	}
+	if _, _, err := Inspect([]byte("<svg></svg>")); err != ErrUnsupportedFormat {
+		t.Errorf("Inspect(svg) = %v, want ErrUnsupportedFormat", err)
+	}
+}
+
+// TestMalformedInput feeds truncated and corrupted images through everything that reads
+// an upload, none of it may panic
+func TestMalformedInput(t *testing.T) {
+	validJPEG := withSegments(encodeJPEG(t, solid(16, 8)), segment(0xE1, orientationExif(6)))
+	validPNG := encodePNG(t, solid(16, 8))
+
+	var inputs [][]byte
+	for _, valid := range [][]byte{validJPEG, validPNG} {
+		for n := 0; n < len(valid); n++ {
+			inputs = append(inputs, valid[:n])
+		}
+		corrupted := append([]byte{}, valid...)
+		for i := 2; i < len(corrupted); i += 7 {
+			corrupted[i] ^= 0xFF
+		}
+		inputs = append(inputs, corrupted)
+	}
+	inputs = append(inputs,
+		nil,
+		[]byte{0xFF, 0xD8},
+		[]byte{0xFF, 0xD8, 0xFF, 0xE1, 0x00, 0x00},
+		[]byte{0xFF, 0xD8, 0xFF, 0xE1, 0xFF, 0xFF, 'E', 'x'},
+		withSegments([]byte{0xFF, 0xD8, 0xFF, 0xD9}, segment(0xE1, append([]byte("Exif\x00\x00II*\x00"), 0xFF, 0xFF, 0xFF, 0x7F))),
+		withSegments([]byte{0xFF, 0xD8, 0xFF, 0xD9}, segment(0xE1, append([]byte("Exif\x00\x00MM\x00*\x00\x00\x00\x08"), 0xFF, 0xFF))),
+		append(append([]byte{}, pngSignature...), 0xFF, 0xFF, 0xFF, 0xFF, 'I', 'D', 'A', 'T'),
+		bytes.Repeat([]byte{0xFF}, 64),
+	)
+
+	for i, input := range inputs {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					t.Errorf("input %d (%d bytes) panicked: %v", i, len(input), r)
+				}
+			}()
+			Inspect(input)
+			if img, err := Decode(input); err == nil {
+				if original, err := img.Original(); err == nil {
+					Inspect(original)
+				}
+				img.Render(&bytes.Buffer{}, Thumbnail)
+			}
+			jpegOrientation(input)
+			stripJPEGMetadata(input, 6)
+			stripPNGMetadata(input)
+		}()
+	}
+
+	if _, err := Decode(validJPEG[:len(validJPEG)/2]); err == nil {
+		t.Error("Decode accepted a truncated JPEG")
+	}
+}
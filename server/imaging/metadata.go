@@ -0,0 +1,206 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+)
+
+const exifTagOrientation = 0x0112
+
+var (
+	exifHeader   = []byte("Exif\x00\x00")
+	pngSignature = []byte("\x89PNG\r\n\x1a\n")
+)
+
+// jpegSegment is a marker segment before the image data, start is the index of its 0xFF
+type jpegSegment struct {
+	marker     byte
+	start, end int
+	payload    []byte
+}
+
+// jpegSegments lists the segments of a JPEG up to the start of scan, returning the
+// index where the scan begins
+func jpegSegments(data []byte) ([]jpegSegment, int) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return nil, -1
+	}
+
+	var segments []jpegSegment
+	i := 2
+	for i+4 <= len(data) {
+		if data[i] != 0xFF {
+			return nil, -1
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xFF:
+			// Fill byte before a marker
+			i++
+			continue
+		case marker == 0x01 || (marker >= 0xD0 && marker <= 0xD7):
+			i += 2
+			continue
+		case marker == 0xDA || marker == 0xD9:
+			return segments, i
+		}
+
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return nil, -1
+		}
+		segments = append(segments, jpegSegment{marker: marker, start: i, end: i + 2 + length, payload: data[i+4 : i+2+length]})
+		i += 2 + length
+	}
+	return nil, -1
+}
+
+// jpegOrientation reads the EXIF orientation of a JPEG, 1 when there is none
+func jpegOrientation(data []byte) int {
+	segments, _ := jpegSegments(data)
+	for _, segment := range segments {
+		if segment.marker == 0xE1 && bytes.HasPrefix(segment.payload, exifHeader) {
+			return exifOrientation(segment.payload[len(exifHeader):])
+		}
+	}
+	return 1
+}
+
+// exifOrientation finds the orientation tag in the first IFD of a TIFF structure
+func exifOrientation(tiff []byte) int {
+	if len(tiff) < 8 {
+		return 1
+	}
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 1
+	}
+
+	offset := int(order.Uint32(tiff[4:8]))
+	if offset < 8 || offset+2 > len(tiff) {
+		return 1
+	}
+	count := int(order.Uint16(tiff[offset:]))
+	for k := 0; k < count; k++ {
+		entry := offset + 2 + k*12
+		if entry+12 > len(tiff) {
+			return 1
+		}
+		if order.Uint16(tiff[entry:]) == exifTagOrientation {
+			if value := int(order.Uint16(tiff[entry+8:])); value >= 1 && value <= 8 {
+				return value
+			}
+			return 1
+		}
+	}
+	return 1
+}
+
+// orientationExif builds an EXIF segment payload that only holds the orientation
+func orientationExif(orientation int) []byte {
+	payload := append([]byte{}, exifHeader...)
+	payload = append(payload, 'M', 'M', 0x00, 0x2A, 0x00, 0x00, 0x00, 0x08)
+	payload = binary.BigEndian.AppendUint16(payload, 1) // one entry
+	payload = binary.BigEndian.AppendUint16(payload, exifTagOrientation)
+	payload = binary.BigEndian.AppendUint16(payload, 3) // SHORT
+	payload = binary.BigEndian.AppendUint32(payload, 1)
+	payload = binary.BigEndian.AppendUint16(payload, uint16(orientation))
+	payload = append(payload, 0x00, 0x00)
+	return binary.BigEndian.AppendUint32(payload, 0) // no next IFD
+}
+
+// stripJPEGMetadata drops EXIF, XMP, IPTC and comment segments from a JPEG and puts
+// back an EXIF segment with only the orientation. It reports false when the segments
+// cannot be parsed, the metadata may then still be in there.
+func stripJPEGMetadata(data []byte, orientation int) ([]byte, bool) {
+	segments, scan := jpegSegments(data)
+	if scan < 0 {
+		return nil, false
+	}
+
+	out := []byte{0xFF, 0xD8}
+	if orientation != 1 {
+		payload := orientationExif(orientation)
+		out = append(out, 0xFF, 0xE1)
+		out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+		out = append(out, payload...)
+	}
+	for _, segment := range segments {
+		// APP1 holds EXIF and XMP, APP13 holds IPTC
+		if segment.marker == 0xE1 || segment.marker == 0xED || segment.marker == 0xFE {
+			continue
+		}
+		out = append(out, data[segment.start:segment.end]...)
+	}
+	return append(out, data[scan:]...), true
+}
+
+// stripPNGMetadata drops the EXIF, text and time chunks from a PNG. It reports false
+// when the chunks cannot be parsed.
+func stripPNGMetadata(data []byte) ([]byte, bool) {
+	if !bytes.HasPrefix(data, pngSignature) {
+		return nil, false
+	}
+
+	out := append([]byte{}, pngSignature...)
+	i := len(pngSignature)
+	for i+12 <= len(data) {
+		length := int(binary.BigEndian.Uint32(data[i:]))
+		end := i + 12 + length
+		if length < 0 || end > len(data) {
+			return nil, false
+		}
+		switch string(data[i+4 : i+8]) {
+		case "eXIf", "tEXt", "zTXt", "iTXt", "tIME":
+		default:
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, true
+}
+
+// orient turns an image upright according to its EXIF orientation
+func orient(src *image.RGBA, orientation int) *image.RGBA {
+	if orientation <= 1 || orientation > 8 {
+		return src
+	}
+
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		// Orientations 5 to 8 swap width and height
+		dw, dh = h, w
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2: // mirrored
+				sx, sy = w-1-x, y
+			case 3: // rotated 180°
+				sx, sy = w-1-x, h-1-y
+			case 4: // flipped vertically
+				sx, sy = x, h-1-y
+			case 5: // transposed
+				sx, sy = y, x
+			case 6: // rotated 90° clockwise
+				sx, sy = y, h-1-x
+			case 7: // transversed
+				sx, sy = w-1-y, h-1-x
+			case 8: // rotated 90° counter-clockwise
+				sx, sy = w-1-y, x
+			}
+			copy(dst.Pix[y*dst.Stride+x*4:y*dst.Stride+x*4+4], src.Pix[sy*src.Stride+sx*4:])
+		}
+	}
+	return dst
+}
@@ -0,0 +1,250 @@
+package imaging
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"testing"
+)
+
+// segment builds a JPEG marker segment around payload
+func segment(marker byte, payload []byte) []byte {
+	out := []byte{0xFF, marker}
+	out = binary.BigEndian.AppendUint16(out, uint16(len(payload)+2))
+	return append(out, payload...)
+}
+
+// withSegments inserts segments right after the start of image marker of a JPEG
+func withSegments(jpegData []byte, segments ...[]byte) []byte {
+	out := append([]byte{}, jpegData[:2]...)
+	for _, s := range segments {
+		out = append(out, s...)
+	}
+	return append(out, jpegData[2:]...)
+}
+
+func markers(t *testing.T, data []byte) []byte {
+	t.Helper()
+	segments, scan := jpegSegments(data)
+	if scan < 0 {
+		t.Fatal("not a well formed JPEG")
+	}
+	var found []byte
+	for _, s := range segments {
+		found = append(found, s.marker)
+	}
+	return found
+}
+
+var (
+	topLeft     = color.RGBA{0xFF, 0x00, 0x00, 0xFF}
+	topRight    = color.RGBA{0x00, 0xFF, 0x00, 0xFF}
+	bottomLeft  = color.RGBA{0x00, 0x00, 0xFF, 0xFF}
+	bottomRight = color.RGBA{0xFF, 0xFF, 0x00, 0xFF}
+)
+
+// marked is a 3x2 image with a distinct colour in each corner
+func marked() *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, 3, 2))
+	img.SetRGBA(0, 0, topLeft)
+	img.SetRGBA(2, 0, topRight)
+	img.SetRGBA(0, 1, bottomLeft)
+	img.SetRGBA(2, 1, bottomRight)
+	return img
+}
+
+func TestOrient(t *testing.T) {
+	// Corners of the upright image, reading clockwise from the top left, as stored by the camera
+	tests := []struct {
+		orientation int
+		w, h        int
+		corners     [4]color.RGBA
+	}{
+		{1, 3, 2, [4]color.RGBA{topLeft, topRight, bottomRight, bottomLeft}},
+		{2, 3, 2, [4]color.RGBA{topRight, topLeft, bottomLeft, bottomRight}},
+		{3, 3, 2, [4]color.RGBA{bottomRight, bottomLeft, topLeft, topRight}},
+		{4, 3, 2, [4]color.RGBA{bottomLeft, bottomRight, topRight, topLeft}},
+		{5, 2, 3, [4]color.RGBA{topLeft, bottomLeft, bottomRight, topRight}},
+		{6, 2, 3, [4]color.RGBA{bottomLeft, topLeft, topRight, bottomRight}},
+		{7, 2, 3, [4]color.RGBA{bottomRight, topRight, topLeft, bottomLeft}},
+		{8, 2, 3, [4]color.RGBA{topRight, bottomRight, bottomLeft, topLeft}},
+		{0, 3, 2, [4]color.RGBA{topLeft, topRight, bottomRight, bottomLeft}},
+		{9, 3, 2, [4]color.RGBA{topLeft, topRight, bottomRight, bottomLeft}},
+	}
+	for _, tt := range tests {
+		got := orient(marked(), tt.orientation)
+		w, h := got.Bounds().Dx(), got.Bounds().Dy()
+		if w != tt.w || h != tt.h {
+			t.Errorf("orientation %d: size %dx%d, want %dx%d", tt.orientation, w, h, tt.w, tt.h)
+			continue
+		}
+		corners := [4]color.RGBA{got.RGBAAt(0, 0), got.RGBAAt(w-1, 0), got.RGBAAt(w-1, h-1), got.RGBAAt(0, h-1)}
+		if corners != tt.corners {
+			t.Errorf("orientation %d: corners %v, want %v", tt.orientation, corners, tt.corners)
+		}
+	}
+}
+
+func TestJPEGOrientation(t *testing.T) {
+	base := encodeJPEG(t, solid(30, 20))
+	for orientation := 1; orientation <= 8; orientation++ {
+		data := withSegments(base, segment(0xE1, orientationExif(orientation)))
+		if got := jpegOrientation(data); got != orientation {
+			t.Errorf("jpegOrientation = %d, want %d", got, orientation)
+		}
+
+		img, err := Decode(data)
+		if err != nil {
+			t.Fatalf("orientation %d: %v", orientation, err)
+		}
+		w, h := 30, 20
+		if orientation >= 5 {
+			w, h = 20, 30
+		}
+		if b := img.Bounds(); b.Dx() != w || b.Dy() != h {
+			t.Errorf("orientation %d decoded as %dx%d, want %dx%d", orientation, b.Dx(), b.Dy(), w, h)
+		}
+	}
+
+	littleEndian := []byte("Exif\x00\x00II*\x00\x08\x00\x00\x00\x01\x00\x12\x01\x03\x00\x01\x00\x00\x00\x03\x00\x00\x00\x00\x00\x00\x00")
+	if got := jpegOrientation(withSegments(base, segment(0xE1, littleEndian))); got != 3 {
+		t.Errorf("little endian EXIF orientation = %d, want 3", got)
+	}
+	if got := jpegOrientation(base); got != 1 {
+		t.Errorf("orientation without EXIF = %d, want 1", got)
+	}
+}
+
+func TestStripJPEGMetadata(t *testing.T) {
+	base := encodeJPEG(t, solid(30, 20))
+	exif := append(orientationExif(6), []byte("Canon EOS GPS 51.5007N 0.1246W")...)
+	xmp := []byte("http://ns.adobe.com/xap/1.0/\x00<x:xmpmeta>secret</x:xmpmeta>")
+	iptc := []byte("Photoshop 3.0\x008BIM secret caption")
+	comment := []byte("secret comment")
+	data := withSegments(base, segment(0xE1, exif), segment(0xE1, xmp), segment(0xED, iptc), segment(0xFE, comment))
+
+	tests := []struct {
+		orientation int
+		app1        int
+	}{
+		{6, 1},
+		{1, 0},
+	}
+	for _, tt := range tests {
+		stripped, ok := stripJPEGMetadata(data, tt.orientation)
+		if !ok {
+			t.Fatalf("orientation %d: segments not parsed", tt.orientation)
+		}
+
+		app1 := 0
+		for _, marker := range markers(t, stripped) {
+			switch marker {
+			case 0xE1:
+				app1++
+			case 0xED, 0xFE:
+				t.Errorf("orientation %d: segment %#x kept", tt.orientation, marker)
+			}
+		}
+		if app1 != tt.app1 {
+			t.Errorf("orientation %d: %d APP1 segments, want %d", tt.orientation, app1, tt.app1)
+		}
+		if bytes.Contains(stripped, []byte("secret")) || bytes.Contains(stripped, []byte("GPS")) {
+			t.Errorf("orientation %d: metadata left in the image", tt.orientation)
+		}
+		if got := jpegOrientation(stripped); got != tt.orientation {
+			t.Errorf("orientation after stripping = %d, want %d", got, tt.orientation)
+		}
+		if _, _, err := Inspect(stripped); err != nil {
+			t.Errorf("orientation %d: stripped image no longer decodes: %v", tt.orientation, err)
+		}
+	}
+
+	// Everything from the start of scan on is left alone
+	_, scan := jpegSegments(base)
+	stripped, _ := stripJPEGMetadata(data, 6)
+	_, strippedScan := jpegSegments(stripped)
+	if !bytes.Equal(stripped[strippedScan:], base[scan:]) {
+		t.Error("image data changed while stripping metadata")
+	}
+}
+
+func TestOriginalStripsPNGMetadata(t *testing.T) {
+	data := encodePNG(t, solid(4, 4))
+
+	// Insert a text chunk after IHDR
+	ihdrEnd := len(pngSignature) + 12 + 13
+	body := append([]byte("tEXt"), "Comment\x00secret"...)
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(body)-4))
+	chunk = binary.BigEndian.AppendUint32(append(chunk, body...), crc32.ChecksumIEEE(body))
+	withText := append(append(append([]byte{}, data[:ihdrEnd]...), chunk...), data[ihdrEnd:]...)
+
+	img, err := Decode(withText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	original, err := img.Original()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(original, []byte("secret")) {
+		t.Error("text chunk kept")
+	}
+	if !bytes.Equal(original, data) {
+		t.Error("stripping changed more than the text chunk")
+	}
+}
+
+// TestOriginalReencodesUnparsableJPEG covers files the decoder accepts although their
+// segments cannot be parsed, here a stray byte after the EXIF segment
+func TestOriginalReencodesUnparsableJPEG(t *testing.T) {
+	base := encodeJPEG(t, solid(30, 20))
+	exif := append(orientationExif(6), []byte("GPS 51.5007N 0.1246W")...)
+	data := withSegments(base, segment(0xE1, exif), []byte{0x00})
+
+	if _, ok := stripJPEGMetadata(data, 6); ok {
+		t.Fatal("segments with a stray byte were parsed, the test no longer covers the fallback")
+	}
+	img, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	original, err := img.Original()
+	if err != nil {
+		t.Fatalf("Original: %v", err)
+	}
+	if bytes.Contains(original, []byte("GPS")) || bytes.Contains(original, exifHeader) {
+		t.Error("metadata left in the original")
+	}
+
+	// The orientation cannot be read either, so the original matches the variants
+	config, format, err := Inspect(original)
+	if err != nil || format != "jpeg" || config.Width != 30 || config.Height != 20 {
+		t.Errorf("original is %s %dx%d (%v), want a jpeg 30x20", format, config.Width, config.Height, err)
+	}
+	if got := jpegOrientation(original); got != 1 {
+		t.Errorf("orientation of the re-encoded original = %d, want 1", got)
+	}
+}
+
+func TestOriginalReencodesUnparsablePNG(t *testing.T) {
+	data := encodePNG(t, solid(4, 4))
+	// Garbage after IEND is ignored by the decoder but breaks the chunk list
+	data = append(data, []byte("\x00\x00\xff\xfftEXtComment\x00secret")...)
+
+	img, err := Decode(data)
+	if err != nil {
+		t.Fatalf("Decode: %v", err)
+	}
+	original, err := img.Original()
+	if err != nil {
+		t.Fatalf("Original: %v", err)
+	}
+	if bytes.Contains(original, []byte("secret")) {
+		t.Error("trailing data kept in the original")
+	}
+	if _, format, err := Inspect(original); err != nil || format != "png" {
+		t.Errorf("original is %s (%v), want png", format, err)
+	}
+}
@@ -0,0 +1,34 @@
+package mail
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileMailer stores every email as an .eml file in a directory, for development
+// and for inspecting what would have been sent.
+type FileMailer struct {
+	dir string
+}
+
+func NewFileMailer(dir string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileMailer{dir: dir}, nil
+}
+
+func (m *FileMailer) Send(message Message) error {
+	buf := make([]byte, 6)
+	if _, err := rand.Read(buf); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	name := fmt.Sprintf("%s-%s.eml", now.Format("20060102-150405"), hex.EncodeToString(buf))
+	return os.WriteFile(filepath.Join(m.dir, name), []byte(format(message, now)), 0644)
+}
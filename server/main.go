@@ -4,12 +4,18 @@ import (
 	"fmt"
 	"ibuy-server/db"
 	routeHandler "ibuy-server/handlers"
+	"ibuy-server/mail"
 	"ibuy-server/middleware"
+	"ibuy-server/payment"
+	"ibuy-server/push"
 	"ibuy-server/router"
+	"ibuy-server/storage"
 	"ibuy-server/websocket"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -42,16 +48,105 @@ func main() {
 	
 	go hub.Run()
 
+	// Only the in-process fake provider exists so far; real providers plug in here.
+	// The fake one lets buyers confirm their own payments, so it has to be asked for.
+	paymentProvider := os.Getenv("PAYMENT_PROVIDER")
+	if paymentProvider != "" {
+		webhookSecret := os.Getenv("PAYMENT_WEBHOOK_SECRET")
+		if webhookSecret == "" {
+			log.Fatal("PAYMENT_WEBHOOK_SECRET must be set when PAYMENT_PROVIDER is set")
+		}
+		switch paymentProvider {
+		case "fake":
+			routeHandler.Payments = payment.NewFakeProvider(webhookSecret)
+		default:
+			log.Fatalf("Unknown PAYMENT_PROVIDER %q", paymentProvider)
+		}
+	} else {
+		log.Println("Warning: PAYMENT_PROVIDER not set, checkout is disabled")
+	}
+
+	if minAmount, err := strconv.ParseFloat(os.Getenv("ESCROW_MIN_AMOUNT"), 32); err == nil {
+		routeHandler.Escrow.MinAmount = float32(minAmount)
+	}
+	if releaseDays, err := strconv.Atoi(os.Getenv("ESCROW_RELEASE_DAYS")); err == nil {
+		routeHandler.Escrow.ReleaseAfter = time.Duration(releaseDays) * 24 * time.Hour
+	}
+	go routeHandler.RunEscrowReleaser(routeHandler.Escrow)
+
+	// Emails are written to MAIL_DIR when set, otherwise only logged
+	if mailDir := os.Getenv("MAIL_DIR"); mailDir != "" {
+		fileMailer, err := mail.NewFileMailer(mailDir)
+		if err != nil {
+			log.Fatalf("Failed to create mail directory: %v", err)
+		}
+		routeHandler.Mailer = fileMailer
+	}
+	if delayMinutes, err := strconv.Atoi(os.Getenv("DIGEST_DELAY_MINUTES")); err == nil {
+		routeHandler.Digest.Delay = time.Duration(delayMinutes) * time.Minute
+	}
+	go routeHandler.RunDigestMailer(routeHandler.Digest)
+	go routeHandler.RunViewRecorder(routeHandler.Views)
+
+	if expiryDays, err := strconv.Atoi(os.Getenv("LISTING_EXPIRY_DAYS")); err == nil {
+		routeHandler.Expiry.ListingPeriod = time.Duration(expiryDays) * 24 * time.Hour
+	}
+	go routeHandler.RunListingExpirer(routeHandler.Expiry)
+	go routeHandler.RunOfferExpirer(routeHandler.Offers)
+	go routeHandler.RunImportWatchdog()
+	go routeHandler.RunScheduledPublisher(routeHandler.Publishing)
+
+	if trashDays, err := strconv.Atoi(os.Getenv("TRASH_RETENTION_DAYS")); err == nil {
+		routeHandler.Trash.RetentionPeriod = time.Duration(trashDays) * 24 * time.Hour
+	}
+	go routeHandler.RunTrashPurger(routeHandler.Trash)
+
+	// Images live on local disk unless an S3 compatible bucket is configured, which
+	// every replica of the server can share
+	if bucket := os.Getenv("S3_BUCKET"); bucket != "" {
+		routeHandler.Images = storage.NewS3Store(storage.S3Config{
+			Endpoint:  os.Getenv("S3_ENDPOINT"),
+			Region:    os.Getenv("S3_REGION"),
+			Bucket:    bucket,
+			AccessKey: os.Getenv("S3_ACCESS_KEY"),
+			SecretKey: os.Getenv("S3_SECRET_KEY"),
+			PublicURL: os.Getenv("S3_PUBLIC_URL"),
+		})
+	}
+
+	// Exports link to images with the server's public address
+	routeHandler.PublicURL = os.Getenv("PUBLIC_URL")
+
+	// Images uploaded before resized variants existed get them rendered once
+	go routeHandler.RunImageVariantBackfill()
+
+	// Web push needs a stable VAPID key, otherwise browsers have to subscribe again after every restart
+	var vapidKeys *push.VAPIDKeys
+	if encodedKey := os.Getenv("VAPID_PRIVATE_KEY"); encodedKey != "" {
+		vapidKeys, err = push.ParseVAPIDPrivateKey(encodedKey)
+		if err != nil {
+			log.Fatalf("Invalid VAPID_PRIVATE_KEY: %v", err)
+		}
+	} else {
+		vapidKeys, err = push.GenerateVAPIDKeys()
+		if err != nil {
+			log.Fatalf("Failed to generate VAPID keys: %v", err)
+		}
+		log.Println("Warning: VAPID_PRIVATE_KEY not set, using a generated key until restart; set it to keep push subscriptions working")
+	}
+	vapidSubject := os.Getenv("VAPID_SUBJECT")
+	if vapidSubject == "" {
+		vapidSubject = "mailto:admin@localhost"
+	}
+	routeHandler.Push = push.NewSender(vapidKeys, vapidSubject)
+
 	mux := router.NewMiddlewareMux(middleware.CORS(), middleware.Logging(), middleware.Auth())
 
 	mux.Handle("OPTIONS /", func(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 	})
 
-	fileServer := http.FileServer(http.Dir("./"))
-	mux.Handle("GET /uploads/products/", func(w http.ResponseWriter, r *http.Request) {
-		http.StripPrefix("/", fileServer).ServeHTTP(w, r)
-	})
+	mux.Handle("GET /uploads/products/", routeHandler.ServeImage)
 
 	//User handling
 	mux.Handle("POST /register", routeHandler.AddUser)
@@ -63,9 +158,87 @@ func main() {
 	mux.Handle("GET /home", routeHandler.GetCategoryProducts)
 	mux.Handle("GET /product", routeHandler.GetUserProducts)
 	mux.Handle("GET /product/{id}", routeHandler.GetProductById)
+	mux.Handle("PATCH /product/{id}", routeHandler.PatchProduct)
 	mux.Handle("POST /product", routeHandler.AddProduct)
 	mux.Handle("PUT /product", routeHandler.UpdateProduct)
 	mux.Handle("DELETE /product", routeHandler.DeleteProductById)
+	mux.Handle("GET /product/{id}/price-history", routeHandler.GetPriceHistory)
+	mux.Handle("POST /product/{id}/renew", routeHandler.RenewProduct)
+	mux.Handle("POST /product/{id}/publish", routeHandler.PublishProduct)
+	mux.Handle("POST /product/{id}/duplicate", routeHandler.DuplicateProduct)
+	mux.Handle("POST /products/import", routeHandler.ImportProducts)
+	mux.Handle("GET /products/import/{id}", routeHandler.GetImportJob)
+	mux.Handle("POST /products/bulk", routeHandler.BulkUpdateProducts)
+	mux.Handle("GET /me/products/export", routeHandler.ExportProducts)
+	mux.Handle("GET /me/trash", routeHandler.GetTrash)
+	mux.Handle("POST /product/{id}/restore", routeHandler.RestoreProduct)
+	mux.Handle("GET /me/analytics", routeHandler.GetAnalytics)
+
+	//Transactions
+	mux.Handle("GET /product/{id}/buyers", routeHandler.GetInterestedBuyers)
+	mux.Handle("GET /me/purchases", routeHandler.GetPurchases)
+	mux.Handle("GET /me/sales", routeHandler.GetSales)
+
+	//Offers
+	mux.Handle("POST /product/{id}/offers", routeHandler.MakeOffer)
+	mux.Handle("POST /offers/{id}/accept", routeHandler.AcceptOffer)
+	mux.Handle("POST /offers/{id}/decline", routeHandler.DeclineOffer)
+	mux.Handle("POST /offers/{id}/counter", routeHandler.CounterOffer)
+
+	//Address book
+	mux.Handle("GET /me/addresses", routeHandler.GetAddresses)
+	mux.Handle("POST /me/addresses", routeHandler.AddAddress)
+	mux.Handle("PUT /me/addresses/{id}", routeHandler.UpdateAddress)
+	mux.Handle("DELETE /me/addresses/{id}", routeHandler.DeleteAddress)
+
+	//Orders
+	mux.Handle("POST /product/{id}/orders", routeHandler.CreateOrder)
+	mux.Handle("GET /orders/{id}", routeHandler.GetOrder)
+	mux.Handle("GET /me/orders", routeHandler.GetUserOrders)
+	mux.Handle("POST /orders/{id}/ship", routeHandler.ShipOrder)
+	mux.Handle("POST /orders/{id}/complete", routeHandler.CompleteOrder)
+	mux.Handle("POST /orders/{id}/cancel", routeHandler.CancelOrder)
+	mux.Handle("POST /orders/{id}/refund", routeHandler.RefundOrder)
+	mux.Handle("PUT /orders/{id}/tracking", routeHandler.AddTracking)
+	mux.Handle("POST /orders/{id}/dispute", routeHandler.DisputeOrder)
+	mux.Handle("POST /payments/webhook", routeHandler.PaymentWebhook)
+	if paymentProvider == "fake" {
+		mux.Handle("POST /payments/fake/{reference}/confirm", routeHandler.ConfirmFakePayment)
+	}
+
+	//Escrow and ledger
+	mux.Handle("GET /me/balance", routeHandler.GetBalance)
+	mux.Handle("POST /admin/orders/{id}/resolve", routeHandler.ResolveDispute, middleware.Admin())
+	mux.Handle("GET /admin/ledger/reconcile", routeHandler.ReconcileLedger, middleware.Admin())
+
+	//Reviews
+	mux.Handle("POST /product/{id}/reviews", routeHandler.AddReview)
+	mux.Handle("GET /users/{id}/reviews", routeHandler.GetUserReviews)
+	mux.Handle("PUT /reviews/{id}/response", routeHandler.RespondToReview)
+
+	//Watchlist
+	mux.Handle("GET /me/watchlist", routeHandler.GetWatchlist)
+	mux.Handle("POST /me/watchlist/{productId}", routeHandler.AddToWatchlist)
+	mux.Handle("DELETE /me/watchlist/{productId}", routeHandler.RemoveFromWatchlist)
+
+	//Search and saved searches
+	mux.Handle("GET /products/search", routeHandler.SearchProducts)
+	mux.Handle("GET /me/saved-searches", routeHandler.GetSavedSearches)
+	mux.Handle("POST /me/saved-searches", routeHandler.AddSavedSearch)
+	mux.Handle("DELETE /me/saved-searches/{id}", routeHandler.DeleteSavedSearch)
+
+	//Notifications
+	mux.Handle("GET /notifications", routeHandler.GetNotifications)
+	mux.Handle("PUT /notifications/read", routeHandler.MarkAllNotificationsRead)
+	mux.Handle("PUT /notifications/{id}/read", routeHandler.MarkNotificationRead)
+	mux.Handle("GET /me/notification-preferences", routeHandler.GetNotificationPreferences)
+	mux.Handle("PUT /me/notification-preferences", routeHandler.UpdateNotificationPreferences)
+
+	//Web push
+	mux.Handle("GET /push/vapid-public-key", routeHandler.GetVapidPublicKey)
+	mux.Handle("GET /me/push-subscriptions", routeHandler.GetPushSubscriptions)
+	mux.Handle("POST /me/push-subscriptions", routeHandler.AddPushSubscription)
+	mux.Handle("DELETE /me/push-subscriptions/{id}", routeHandler.DeletePushSubscription)
 
 	//Categories
 	mux.Handle("GET /category", routeHandler.GetCategories)
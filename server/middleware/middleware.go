@@ -3,6 +3,7 @@ package middleware
 import (
 	"context"
 	crypto "ibuy-server/auth"
+	"ibuy-server/db"
 	user "ibuy-server/handlers"
 	"log"
 	"net/http"
@@ -28,8 +29,8 @@ func Logging() Middleware {
 func Auth() Middleware {
 	return func(next http.HandlerFunc) http.HandlerFunc {
 		return func(w http.ResponseWriter, r *http.Request) {
-			// Skip authentication for /login and /register
-			if r.URL.Path == "/login" || r.URL.Path == "/register" || r.URL.Path == "/ws" {
+			// Skip authentication for /login and /register, the payment webhook is verified by its signature
+			if r.URL.Path == "/login" || r.URL.Path == "/register" || r.URL.Path == "/ws" || r.URL.Path == "/payments/webhook" {
 				next(w, r)
 				return
 			}
@@ -59,6 +60,28 @@ func Auth() Middleware {
 	}
 }
 
+// Admin only lets users flagged as admin through. It must run after Auth.
+func Admin() Middleware {
+	return func(next http.HandlerFunc) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			userContext, ok := r.Context().Value("userContext").(user.UserContext)
+			if !ok {
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			var isAdmin bool
+			err := db.DB.QueryRow("SELECT is_admin FROM web_user WHERE u_id = $1", userContext.UserId).Scan(&isAdmin)
+			if err != nil || !isAdmin {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			next(w, r)
+		}
+	}
+}
+
 // CORS middleware function
 func CORS() Middleware {
     return func(next http.HandlerFunc) http.HandlerFunc {
@@ -72,8 +95,9 @@ func CORS() Middleware {
                 w.Header().Set("Access-Control-Allow-Credentials", "true")
             }
             
-            w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, DELETE, OPTIONS")
-            w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Cookie")
+            w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, DELETE, OPTIONS")
+            w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, Cookie, If-Match")
+            w.Header().Set("Access-Control-Expose-Headers", "ETag")
 
 			// Handle preflight OPTIONS request
             if r.Method == "OPTIONS" {
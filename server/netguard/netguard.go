@@ -0,0 +1,109 @@
+// Package netguard makes requests to URLs that users supplied without letting them
+// reach the server's own network, such as loopback, private ranges or cloud metadata.
+package netguard
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+var (
+	ErrNotHTTPS         = errors.New("only https URLs are allowed")
+	ErrForbiddenAddress = errors.New("address is not publicly routable")
+)
+
+const maxRedirects = 5
+
+// Ranges netip does not flag: "this network", which Linux dials as loopback, and
+// the carrier-grade NAT range
+var reservedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+}
+
+// Allowed reports whether an address is a public unicast address
+func Allowed(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range reservedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// CheckURL rejects URLs that are not https or that name a forbidden address directly.
+// Host names are checked again after DNS resolution when the request is dialed.
+func CheckURL(rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "https" || u.Host == "" {
+		return ErrNotHTTPS
+	}
+	if addr, err := netip.ParseAddr(u.Hostname()); err == nil && !Allowed(addr) {
+		return ErrForbiddenAddress
+	}
+	return nil
+}
+
+// control runs after DNS resolution for every connection, so names resolving to
+// internal addresses are refused as well
+func control(network, address string, _ syscall.RawConn) error {
+	addrPort, err := netip.ParseAddrPort(address)
+	if err != nil {
+		return err
+	}
+	if !Allowed(addrPort.Addr()) {
+		return fmt.Errorf("%w: %s", ErrForbiddenAddress, addrPort.Addr())
+	}
+	return nil
+}
+
+// httpsOnly refuses every request that is not https, redirects included
+type httpsOnly struct {
+	next http.RoundTripper
+}
+
+func (t httpsOnly) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Scheme != "https" {
+		return nil, ErrNotHTTPS
+	}
+	return t.next.RoundTrip(req)
+}
+
+// NewClient returns an HTTP client that only talks https to public addresses.
+// It does not use proxies from the environment, which would hide the real target.
+func NewClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: control,
+	}
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		MaxIdleConns:        10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: httpsOnly{next: transport},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= maxRedirects {
+				return errors.New("too many redirects")
+			}
+			return CheckURL(req.URL.String())
+		},
+	}
+}
@@ -0,0 +1,87 @@
+package netguard
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func TestAllowed(t *testing.T) {
+	tests := []struct {
+		addr    string
+		allowed bool
+	}{
+		{"93.184.216.34", true},
+		{"2606:2800:220:1::1", true},
+		{"127.0.0.1", false},
+		{"::1", false},
+		{"10.1.2.3", false},
+		{"172.16.0.1", false},
+		{"192.168.1.1", false},
+		{"169.254.169.254", false},
+		{"fe80::1", false},
+		{"fd00::1", false},
+		{"0.0.0.0", false},
+		{"0.1.2.3", false},
+		{"100.64.0.1", false},
+		{"224.0.0.1", false},
+		{"::ffff:127.0.0.1", false},
+		{"::ffff:93.184.216.34", true},
+	}
+	for _, tt := range tests {
+		if got := Allowed(netip.MustParseAddr(tt.addr)); got != tt.allowed {
+			t.Errorf("Allowed(%s) = %v, want %v", tt.addr, got, tt.allowed)
+		}
+	}
+}
+
+func TestCheckURL(t *testing.T) {
+	tests := []struct {
+		url string
+		err error
+	}{
+		{"https://example.com/image.jpg", nil},
+		{"http://example.com/image.jpg", ErrNotHTTPS},
+		{"file:///etc/passwd", ErrNotHTTPS},
+		{"https:///no-host", ErrNotHTTPS},
+		{"https://127.0.0.1/", ErrForbiddenAddress},
+		{"https://[::1]:8080/", ErrForbiddenAddress},
+		{"https://169.254.169.254/latest/meta-data/", ErrForbiddenAddress},
+	}
+	for _, tt := range tests {
+		if err := CheckURL(tt.url); !errors.Is(err, tt.err) {
+			t.Errorf("CheckURL(%q) = %v, want %v", tt.url, err, tt.err)
+		}
+	}
+}
+
+func TestClientRefusesInternalAddresses(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("request reached the loopback server")
+	}))
+	defer server.Close()
+
+	client := NewClient(5 * time.Second)
+	if _, err := client.Get(server.URL); !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("https to loopback: got %v, want %v", err, ErrForbiddenAddress)
+	}
+	if _, err := client.Get("http://example.com/"); !errors.Is(err, ErrNotHTTPS) {
+		t.Errorf("plain http: got %v, want %v", err, ErrNotHTTPS)
+	}
+}
+
+func TestClientChecksRedirects(t *testing.T) {
+	// The redirect target is checked before anything is dialed
+	client := NewClient(5 * time.Second)
+	req := httptest.NewRequest(http.MethodGet, "https://127.0.0.1/", nil)
+	if err := client.CheckRedirect(req, nil); !errors.Is(err, ErrForbiddenAddress) {
+		t.Errorf("redirect to loopback: got %v, want %v", err, ErrForbiddenAddress)
+	}
+	req = httptest.NewRequest(http.MethodGet, "http://example.com/", nil)
+	if err := client.CheckRedirect(req, nil); !errors.Is(err, ErrNotHTTPS) {
+		t.Errorf("redirect to http: got %v, want %v", err, ErrNotHTTPS)
+	}
+}
@@ -0,0 +1,124 @@
+package payment
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// FakeProvider is an in-process payment provider for development and tests.
+// It never talks to a real payment service; confirmations are produced with SignedEvent
+// and sent to the webhook endpoint like a real provider would.
+type FakeProvider struct {
+	secret   []byte
+	mutex    sync.Mutex
+	payments  map[string]float32
+	cancelled map[string]bool
+	refunds   map[string]float32
+	refunded  map[string]bool
+}
+
+func NewFakeProvider(secret string) *FakeProvider {
+	return &FakeProvider{
+		secret:    []byte(secret),
+		payments:  make(map[string]float32),
+		cancelled: make(map[string]bool),
+		refunds:   make(map[string]float32),
+		refunded:  make(map[string]bool),
+	}
+}
+
+func (p *FakeProvider) Name() string {
+	return "fake"
+}
+
+func (p *FakeProvider) CreatePayment(orderId string, amount float32) (Payment, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return Payment{}, err
+	}
+	reference := "fake_" + hex.EncodeToString(buf)
+
+	p.mutex.Lock()
+	p.payments[reference] = amount
+	p.mutex.Unlock()
+
+	return Payment{
+		Reference:   reference,
+		CheckoutURL: "/payments/fake/" + reference + "/confirm",
+	}, nil
+}
+
+func (p *FakeProvider) CancelPayment(reference string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if _, ok := p.payments[reference]; !ok {
+		return fmt.Errorf("unknown payment %s", reference)
+	}
+	p.cancelled[reference] = true
+	return nil
+}
+
+func (p *FakeProvider) Refund(reference string, amount float32, idempotencyKey string) error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	if p.refunded[idempotencyKey] {
+		return nil
+	}
+
+	paid, ok := p.payments[reference]
+	if !ok {
+		return fmt.Errorf("unknown payment %s", reference)
+	}
+	if p.refunds[reference]+amount > paid {
+		return fmt.Errorf("refund exceeds payment %s", reference)
+	}
+	p.refunds[reference] += amount
+	p.refunded[idempotencyKey] = true
+	return nil
+}
+
+func (p *FakeProvider) ParseWebhook(payload []byte, signature string) (WebhookEvent, error) {
+	if !hmac.Equal([]byte(p.sign(payload)), []byte(signature)) {
+		return WebhookEvent{}, ErrInvalidSignature
+	}
+
+	var event WebhookEvent
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return WebhookEvent{}, err
+	}
+	return event, nil
+}
+
+// SignedEvent builds the webhook payload and signature the provider would send for a payment
+func (p *FakeProvider) SignedEvent(reference string, eventType string) ([]byte, string, error) {
+	p.mutex.Lock()
+	amount, ok := p.payments[reference]
+	cancelled := p.cancelled[reference]
+	p.mutex.Unlock()
+	if !ok {
+		return nil, "", fmt.Errorf("unknown payment %s", reference)
+	}
+	if cancelled && eventType == EventPaymentSucceeded {
+		return nil, "", fmt.Errorf("payment %s was cancelled", reference)
+	}
+
+	payload, err := json.Marshal(WebhookEvent{Type: eventType, Reference: reference, Amount: amount})
+	if err != nil {
+		return nil, "", err
+	}
+	return payload, p.sign(payload), nil
+}
+
+// sign returns the hex encoded HMAC-SHA256 of the payload
+func (p *FakeProvider) sign(payload []byte) string {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write(payload)
+	return hex.EncodeToString(mac.Sum(nil))
+}
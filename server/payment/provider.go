@@ -0,0 +1,38 @@
+package payment
+
+import "errors"
+
+// Webhook event types sent by payment providers
+const (
+	EventPaymentSucceeded = "payment.succeeded"
+	EventPaymentFailed    = "payment.failed"
+)
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Payment is what a provider returns when a checkout is started
+type Payment struct {
+	Reference   string `json:"reference"`
+	CheckoutURL string `json:"checkoutUrl"`
+}
+
+// WebhookEvent is the provider independent form of a payment confirmation
+type WebhookEvent struct {
+	Type      string  `json:"type"`
+	Reference string  `json:"reference"`
+	Amount    float32 `json:"amount"`
+}
+
+// PaymentProvider is implemented by every payment backend the server can take money through
+type PaymentProvider interface {
+	// Name identifies the provider in stored orders
+	Name() string
+	// CreatePayment starts a checkout for an order and returns the provider reference
+	CreatePayment(orderId string, amount float32) (Payment, error)
+	// CancelPayment voids a checkout that was not paid, so it can no longer be paid
+	CancelPayment(reference string) error
+	// Refund pays back a captured payment. Calls repeating an idempotency key pay nothing again.
+	Refund(reference string, amount float32, idempotencyKey string) error
+	// ParseWebhook verifies the signature of a webhook call and decodes its event
+	ParseWebhook(payload []byte, signature string) (WebhookEvent, error)
+}
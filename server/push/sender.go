@@ -0,0 +1,160 @@
+package push
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"ibuy-server/netguard"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// ErrSubscriptionGone is returned when the push service no longer knows a subscription,
+// it should be deleted
+var ErrSubscriptionGone = errors.New("push subscription expired or unsubscribed")
+
+// Subscription is what the browser's PushManager hands out
+type Subscription struct {
+	Endpoint string `json:"endpoint"`
+	P256dh   string `json:"p256dh"` // base64url client public key
+	Auth     string `json:"auth"`   // base64url authentication secret
+}
+
+// Sender delivers encrypted messages to push services
+type Sender struct {
+	keys    *VAPIDKeys
+	subject string // contact for the push service, a mailto: or https: URL
+	client  *http.Client
+	TTL     time.Duration
+}
+
+func NewSender(keys *VAPIDKeys, subject string) *Sender {
+	return &Sender{
+		keys:    keys,
+		subject: subject,
+		// Endpoints come from browsers, so they must not reach into our own network
+		client: netguard.NewClient(10 * time.Second),
+		TTL:    24 * time.Hour,
+	}
+}
+
+func (s *Sender) PublicKey() string {
+	return s.keys.PublicKey()
+}
+
+// Send encrypts payload for the subscription and posts it to its push service
+func (s *Sender) Send(subscription Subscription, payload []byte) error {
+	body, err := encrypt(subscription, payload)
+	if err != nil {
+		return err
+	}
+
+	authorization, err := s.keys.authorization(subscription.Endpoint, s.subject, time.Now())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(s.TTL.Seconds())))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		return ErrSubscriptionGone
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("push service responded with %s", resp.Status)
+	}
+	return nil
+}
+
+const recordSize = 4096
+
+// encrypt implements the aes128gcm content encoding for web push (RFC 8291)
+func encrypt(subscription Subscription, payload []byte) ([]byte, error) {
+	clientPublic, err := base64.RawURLEncoding.DecodeString(subscription.P256dh)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(subscription.Auth)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth secret: %w", err)
+	}
+
+	clientKey, err := ecdh.P256().NewPublicKey(clientPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	serverKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := serverKey.ECDH(clientKey)
+	if err != nil {
+		return nil, err
+	}
+	serverPublic := serverKey.PublicKey().Bytes()
+
+	keyInfo := "WebPush: info\x00" + string(clientPublic) + string(serverPublic)
+	ikm, err := hkdf.Key(sha256.New, sharedSecret, authSecret, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// A single record, terminated by the last-record delimiter
+	plaintext := append(append([]byte{}, payload...), 0x02)
+	if len(plaintext)+gcm.Overhead() > recordSize {
+		return nil, errors.New("push payload too large")
+	}
+
+	header := make([]byte, 0, 16+4+1+len(serverPublic))
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, recordSize)
+	header = append(header, byte(len(serverPublic)))
+	header = append(header, serverPublic...)
+
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
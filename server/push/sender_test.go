@@ -0,0 +1,119 @@
+package push
+
+import (
+	"bytes"
+	"errors"
+	"ibuy-server/netguard"
+	"net/http/httptest"
+	"testing"
+)
+
+// newStubSender serves a StubService over TLS and returns a Sender that may reach it
+func newStubSender(t *testing.T) (*Sender, *StubService, string) {
+	t.Helper()
+	stub := NewStubService()
+	server := httptest.NewTLSServer(stub)
+	t.Cleanup(server.Close)
+
+	keys, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sender := NewSender(keys, "mailto:admin@example.com")
+	// The stub listens on loopback, which the guarded default client refuses
+	sender.client = server.Client()
+	return sender, stub, server.URL
+}
+
+func TestSendDeliversDecryptablePayload(t *testing.T) {
+	sender, stub, baseURL := newStubSender(t)
+	subscription, err := stub.Subscribe(baseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payloads := [][]byte{[]byte(`{"title":"Sold"}`), bytes.Repeat([]byte("x"), 3000)}
+	for _, payload := range payloads {
+		if err := sender.Send(subscription, payload); err != nil {
+			t.Fatalf("Send: %v", err)
+		}
+	}
+
+	delivered := stub.Delivered(subscription)
+	if len(delivered) != len(payloads) {
+		t.Fatalf("delivered %d payloads, want %d", len(delivered), len(payloads))
+	}
+	for i := range payloads {
+		if !bytes.Equal(delivered[i], payloads[i]) {
+			t.Errorf("payload %d = %q, want %q", i, delivered[i], payloads[i])
+		}
+	}
+}
+
+func TestSendToUnsubscribedEndpoint(t *testing.T) {
+	sender, stub, baseURL := newStubSender(t)
+	subscription, err := stub.Subscribe(baseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stub.Unsubscribe(subscription)
+
+	if err := sender.Send(subscription, []byte("hello")); !errors.Is(err, ErrSubscriptionGone) {
+		t.Errorf("Send = %v, want %v", err, ErrSubscriptionGone)
+	}
+}
+
+func TestSendWithWrongKeyIsRejected(t *testing.T) {
+	sender, stub, baseURL := newStubSender(t)
+	subscription, err := stub.Subscribe(baseURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Signed with one key but claiming another
+	sender.keys = &VAPIDKeys{private: other.private, public: sender.keys.public}
+	if err := sender.Send(subscription, []byte("hello")); err == nil {
+		t.Error("Send with a mismatched VAPID key succeeded")
+	}
+	if len(stub.Delivered(subscription)) != 0 {
+		t.Error("payload was delivered despite the bad signature")
+	}
+}
+
+func TestDefaultClientRefusesInternalEndpoints(t *testing.T) {
+	stub := NewStubService()
+	server := httptest.NewTLSServer(stub)
+	defer server.Close()
+
+	keys, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	subscription, err := stub.Subscribe(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sender := NewSender(keys, "mailto:admin@example.com")
+	if err := sender.Send(subscription, []byte("hello")); !errors.Is(err, netguard.ErrForbiddenAddress) {
+		t.Errorf("Send = %v, want %v", err, netguard.ErrForbiddenAddress)
+	}
+}
+
+func TestVAPIDPrivateKeyRoundTrip(t *testing.T) {
+	keys, err := GenerateVAPIDKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseVAPIDPrivateKey(keys.PrivateKey())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if parsed.PublicKey() != keys.PublicKey() {
+		t.Errorf("public key after round trip = %s, want %s", parsed.PublicKey(), keys.PublicKey())
+	}
+}
@@ -0,0 +1,220 @@
+package push
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// StubService is a local stand-in for a browser push service. It hands out
+// subscriptions, checks the VAPID signature of every delivery and decrypts the
+// payload, so the Sender can be exercised without a browser, e.g. behind httptest.
+type StubService struct {
+	mutex     sync.Mutex
+	clients   map[string]*stubClient
+	delivered map[string][][]byte
+}
+
+type stubClient struct {
+	key  *ecdh.PrivateKey
+	auth []byte
+	gone bool
+}
+
+func NewStubService() *StubService {
+	return &StubService{
+		clients:   make(map[string]*stubClient),
+		delivered: make(map[string][][]byte),
+	}
+}
+
+// Subscribe creates a subscription whose endpoint lives under baseURL, the address the stub is served on
+func (s *StubService) Subscribe(baseURL string) (Subscription, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return Subscription{}, err
+	}
+	auth := make([]byte, 16)
+	id := make([]byte, 12)
+	if _, err := rand.Read(auth); err != nil {
+		return Subscription{}, err
+	}
+	if _, err := rand.Read(id); err != nil {
+		return Subscription{}, err
+	}
+
+	path := "/push/" + base64.RawURLEncoding.EncodeToString(id)
+	s.mutex.Lock()
+	s.clients[path] = &stubClient{key: key, auth: auth}
+	s.mutex.Unlock()
+
+	return Subscription{
+		Endpoint: strings.TrimSuffix(baseURL, "/") + path,
+		P256dh:   base64.RawURLEncoding.EncodeToString(key.PublicKey().Bytes()),
+		Auth:     base64.RawURLEncoding.EncodeToString(auth),
+	}, nil
+}
+
+// Unsubscribe makes further deliveries to the subscription fail with 410 Gone
+func (s *StubService) Unsubscribe(subscription Subscription) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for path, client := range s.clients {
+		if strings.HasSuffix(subscription.Endpoint, path) {
+			client.gone = true
+		}
+	}
+}
+
+// Delivered returns the decrypted payloads received for a subscription
+func (s *StubService) Delivered(subscription Subscription) [][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for path, payloads := range s.delivered {
+		if strings.HasSuffix(subscription.Endpoint, path) {
+			return payloads
+		}
+	}
+	return nil
+}
+
+func (s *StubService) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	client, ok := s.clients[r.URL.Path]
+	s.mutex.Unlock()
+	if !ok || client.gone {
+		w.WriteHeader(http.StatusGone)
+		return
+	}
+
+	if err := verifyVAPID(r); err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if r.Header.Get("Content-Encoding") != "aes128gcm" || r.Header.Get("TTL") == "" {
+		http.Error(w, "missing Content-Encoding or TTL header", http.StatusBadRequest)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	payload, err := client.decrypt(body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	s.mutex.Lock()
+	s.delivered[r.URL.Path] = append(s.delivered[r.URL.Path], payload)
+	s.mutex.Unlock()
+	w.WriteHeader(http.StatusCreated)
+}
+
+// verifyVAPID checks the JWT in the Authorization header against the key sent along with it
+func verifyVAPID(r *http.Request) error {
+	var token, key string
+	for _, part := range strings.Split(strings.TrimPrefix(r.Header.Get("Authorization"), "vapid "), ",") {
+		part = strings.TrimSpace(part)
+		if value, ok := strings.CutPrefix(part, "t="); ok {
+			token = value
+		} else if value, ok := strings.CutPrefix(part, "k="); ok {
+			key = value
+		}
+	}
+	if token == "" || key == "" {
+		return errors.New("missing VAPID authorization")
+	}
+
+	raw, err := base64.RawURLEncoding.DecodeString(key)
+	if err != nil {
+		return fmt.Errorf("invalid VAPID key: %w", err)
+	}
+	public, err := ecdsaPublicKey(raw)
+	if err != nil {
+		return fmt.Errorf("invalid VAPID key: %w", err)
+	}
+
+	audience := "http://" + r.Host
+	if r.TLS != nil {
+		audience = "https://" + r.Host
+	}
+	_, err = jwt.Parse(token, func(t *jwt.Token) (any, error) {
+		return public, nil
+	}, jwt.WithValidMethods([]string{jwt.SigningMethodES256.Alg()}), jwt.WithAudience(audience), jwt.WithExpirationRequired())
+	return err
+}
+
+func (c *stubClient) decrypt(body []byte) ([]byte, error) {
+	if len(body) < 21 {
+		return nil, errors.New("body too short")
+	}
+	salt := body[:16]
+	keyLength := int(body[20])
+	if binary.BigEndian.Uint32(body[16:20]) != recordSize || len(body) < 21+keyLength {
+		return nil, errors.New("invalid content coding header")
+	}
+	serverPublic := body[21 : 21+keyLength]
+	ciphertext := body[21+keyLength:]
+
+	serverKey, err := ecdh.P256().NewPublicKey(serverPublic)
+	if err != nil {
+		return nil, err
+	}
+	sharedSecret, err := c.key.ECDH(serverKey)
+	if err != nil {
+		return nil, err
+	}
+
+	keyInfo := "WebPush: info\x00" + string(c.key.PublicKey().Bytes()) + string(serverPublic)
+	ikm, err := hkdf.Key(sha256.New, sharedSecret, c.auth, keyInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	cek, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: aes128gcm\x00", 16)
+	if err != nil {
+		return nil, err
+	}
+	nonce, err := hkdf.Key(sha256.New, ikm, salt, "Content-Encoding: nonce\x00", 12)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Strip the padding and the last-record delimiter
+	end := len(plaintext) - 1
+	for end >= 0 && plaintext[end] == 0 {
+		end--
+	}
+	if end < 0 || plaintext[end] != 0x02 {
+		return nil, errors.New("missing record delimiter")
+	}
+	return plaintext[:end], nil
+}
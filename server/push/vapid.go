@@ -0,0 +1,96 @@
+package push
+
+import (
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"math/big"
+	"net/url"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// VAPIDKeys identify this server to push services (RFC 8292)
+type VAPIDKeys struct {
+	private *ecdsa.PrivateKey
+	public  []byte // uncompressed P-256 point
+}
+
+// GenerateVAPIDKeys creates a new key pair
+func GenerateVAPIDKeys() (*VAPIDKeys, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	ecdhKey, err := key.PublicKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	return &VAPIDKeys{private: key, public: ecdhKey.Bytes()}, nil
+}
+
+// ParseVAPIDPrivateKey loads a key pair from a base64url encoded raw P-256 private key,
+// the format most web push tooling prints
+func ParseVAPIDPrivateKey(encoded string) (*VAPIDKeys, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key encoding: %w", err)
+	}
+	ecdhKey, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %w", err)
+	}
+
+	public := ecdhKey.PublicKey().Bytes()
+	publicKey, err := ecdsaPublicKey(public)
+	if err != nil {
+		return nil, err
+	}
+	key := &ecdsa.PrivateKey{PublicKey: *publicKey, D: new(big.Int).SetBytes(raw)}
+	return &VAPIDKeys{private: key, public: public}, nil
+}
+
+// ecdsaPublicKey converts an uncompressed P-256 point into a key the JWT library can verify with
+func ecdsaPublicKey(raw []byte) (*ecdsa.PublicKey, error) {
+	if _, err := ecdh.P256().NewPublicKey(raw); err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{
+		Curve: elliptic.P256(),
+		X:     new(big.Int).SetBytes(raw[1:33]),
+		Y:     new(big.Int).SetBytes(raw[33:65]),
+	}, nil
+}
+
+// PublicKey returns the base64url encoded public key browsers pass as applicationServerKey
+func (k *VAPIDKeys) PublicKey() string {
+	return base64.RawURLEncoding.EncodeToString(k.public)
+}
+
+// PrivateKey returns the base64url encoded raw private key, for storing generated keys
+func (k *VAPIDKeys) PrivateKey() string {
+	return base64.RawURLEncoding.EncodeToString(k.private.D.FillBytes(make([]byte, 32)))
+}
+
+// authorization builds the Authorization header for a push endpoint
+func (k *VAPIDKeys) authorization(endpoint, subject string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, jwt.MapClaims{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(12 * time.Hour).Unix(),
+		"sub": subject,
+	})
+	signed, err := token.SignedString(k.private)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("vapid t=%s, k=%s", signed, k.PublicKey()), nil
+}
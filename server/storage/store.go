@@ -0,0 +1,25 @@
+package storage
+
+import (
+	"errors"
+	"io"
+)
+
+var (
+	ErrNotFound   = errors.New("blob not found")
+	ErrInvalidKey = errors.New("invalid blob key")
+)
+
+// BlobStore keeps uploaded files under slash separated keys such as
+// uploads/products/<user>/<product>/<file>. Keys are what the database stores.
+type BlobStore interface {
+	Put(key string, data []byte, contentType string) error
+	// Get returns ErrNotFound when nothing is stored under key
+	Get(key string) (io.ReadCloser, error)
+	// Exists reports whether something is stored under key without reading it
+	Exists(key string) (bool, error)
+	// Delete does not fail when nothing is stored under key
+	Delete(key string) error
+	// URL is where clients can fetch the blob. Relative URLs are served by this server.
+	URL(key string) string
+}
@@ -0,0 +1,147 @@
+package storage
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// S3Stub is a local stand-in for an S3 compatible service such as MinIO. It keeps
+// objects in memory and checks the signature of every request, so the S3Store can
+// be exercised without a real bucket, e.g. behind httptest.
+type S3Stub struct {
+	accessKey string
+	secretKey string
+	region    string
+
+	mutex   sync.Mutex
+	objects map[string]stubObject
+}
+
+type stubObject struct {
+	data        []byte
+	contentType string
+}
+
+func NewS3Stub(accessKey, secretKey, region string) *S3Stub {
+	return &S3Stub{
+		accessKey: accessKey,
+		secretKey: secretKey,
+		region:    region,
+		objects:   make(map[string]stubObject),
+	}
+}
+
+// Object returns what is stored under key in bucket
+func (s *S3Stub) Object(bucket, key string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	object, ok := s.objects[bucket+"/"+key]
+	return object.data, ok
+}
+
+func (s *S3Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		writeStubError(w, http.StatusBadRequest, "IncompleteBody", err.Error())
+		return
+	}
+	if err := s.verify(r, body); err != nil {
+		writeStubError(w, http.StatusForbidden, "SignatureDoesNotMatch", err.Error())
+		return
+	}
+
+	// Path style: /<bucket>/<key>
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	if bucket, key, ok := strings.Cut(name, "/"); !ok || bucket == "" || key == "" {
+		writeStubError(w, http.StatusBadRequest, "InvalidRequest", "expected /<bucket>/<key>")
+		return
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	switch r.Method {
+	case http.MethodPut:
+		s.objects[name] = stubObject{data: body, contentType: r.Header.Get("Content-Type")}
+		w.WriteHeader(http.StatusOK)
+	case http.MethodGet, http.MethodHead:
+		object, ok := s.objects[name]
+		if !ok {
+			writeStubError(w, http.StatusNotFound, "NoSuchKey", "The specified key does not exist.")
+			return
+		}
+		if object.contentType != "" {
+			w.Header().Set("Content-Type", object.contentType)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(object.data)))
+		if r.Method == http.MethodGet {
+			w.Write(object.data)
+		}
+	case http.MethodDelete:
+		delete(s.objects, name)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeStubError(w, http.StatusMethodNotAllowed, "MethodNotAllowed", "The specified method is not allowed.")
+	}
+}
+
+// verify recomputes the SigV4 signature of a request with the stub's credentials
+func (s *S3Stub) verify(r *http.Request, body []byte) error {
+	var credential, signedHeaders, signed string
+	authorization, ok := strings.CutPrefix(r.Header.Get("Authorization"), signAlgorithm+" ")
+	if !ok {
+		return errors.New("missing AWS4-HMAC-SHA256 authorization")
+	}
+	for _, part := range strings.Split(authorization, ",") {
+		part = strings.TrimSpace(part)
+		if value, ok := strings.CutPrefix(part, "Credential="); ok {
+			credential = value
+		} else if value, ok := strings.CutPrefix(part, "SignedHeaders="); ok {
+			signedHeaders = value
+		} else if value, ok := strings.CutPrefix(part, "Signature="); ok {
+			signed = value
+		}
+	}
+
+	amzDate := r.Header.Get("X-Amz-Date")
+	requestTime, err := time.Parse(amzDateFormat, amzDate)
+	if err != nil {
+		return errors.New("invalid X-Amz-Date")
+	}
+	if skew := time.Since(requestTime); skew > 15*time.Minute || skew < -15*time.Minute {
+		return errors.New("request time too skewed")
+	}
+	if credential != s.accessKey+"/"+credentialScope(amzDate, s.region) {
+		return errors.New("invalid credential")
+	}
+
+	sum := sha256.Sum256(body)
+	payloadHash := r.Header.Get("X-Amz-Content-Sha256")
+	if payloadHash != hex.EncodeToString(sum[:]) {
+		return errors.New("payload does not match X-Amz-Content-Sha256")
+	}
+
+	expected := signature(s.secretKey, s.region, amzDate,
+		canonicalRequest(r.Method, r.URL.Path, r.URL.Query(), r.Host, r.Header, strings.Split(signedHeaders, ";"), payloadHash))
+	if !hmac.Equal([]byte(signed), []byte(expected)) {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+func writeStubError(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	xml.NewEncoder(w).Encode(struct {
+		XMLName xml.Name `xml:"Error"`
+		s3Error
+	}{s3Error: s3Error{Code: code, Message: message}})
+}
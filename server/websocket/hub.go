@@ -14,6 +14,8 @@ type Message struct {
 	Sender   	string `json:"sender"`   
 	Receiver 	string `json:"receiver"`
 	ProductId 	string `json:"productId"`    
+	OfferId 	string `json:"offerId,omitempty"`
+	Silent  	bool   `json:"-"` // deliver only into an open chat, without a notification otherwise
 }
 
 type NotificationMessage struct {
@@ -22,6 +24,14 @@ type NotificationMessage struct {
 	Sender    string `json:"sender"`
 }
 
+// Notification is pushed to a connected user for events outside of a chat,
+// e.g. a price drop on a watched product
+type Notification struct {
+	Type     string `json:"type"` // "app_notification"
+	Receiver string `json:"-"`
+	Data     any    `json:"data"`
+}
+
 // Message to update which product the user is currently viewing
 type UpdateViewMessage struct {
 	Type      string `json:"type"` // "update_view"
@@ -39,9 +49,11 @@ type Client struct {
 // Hub manages all active connections
 type Hub struct {
 	clients    	map[string]*Client // Map of userID to client
+	clientsMutex sync.RWMutex      // Guards clients for readers outside of Run
 	register   	chan *Client       // Register new clients
 	unregister 	chan *Client       // Unregister clients
 	message 	chan Message
+	notification chan Notification
 }
 
 func NewHub() *Hub {
@@ -50,6 +62,7 @@ func NewHub() *Hub {
 		register:   make(chan *Client),
 		unregister: make(chan *Client),
 		message: 	make(chan Message),
+		notification: make(chan Notification),
 	}
 }
 
@@ -128,13 +141,17 @@ func (h *Hub) Run(){
 					oldClient.Conn.Close()
 				}
 
+				h.clientsMutex.Lock()
 				h.clients[client.UserID] = client
+				h.clientsMutex.Unlock()
 
 				log.Printf("User %s connected. Total connections: %d", client.UserID, len(h.clients))
 
 			case client := <- h.unregister:
 				if existing, ok := h.clients[client.UserID]; ok && existing == client {
+					h.clientsMutex.Lock()
 					delete(h.clients, client.UserID)
+					h.clientsMutex.Unlock()
 					client.Conn.Close()
 				}
 				log.Printf("User %s disconnected. Total connections: %d", client.UserID, len(h.clients))
@@ -146,15 +163,38 @@ func (h *Hub) Run(){
                 } else {
 					log.Printf("User %s is not connected, message not delivered but saved in db", message.Receiver)
 				}
+
+			case notification := <- h.notification:
+				receiver, ok := h.clients[notification.Receiver]
+				if !ok {
+					continue
+				}
+				if err := receiver.Conn.WriteJSON(notification); err != nil {
+					log.Printf("Error sending notification to %s: %v", notification.Receiver, err)
+					go func() { h.unregister <- receiver }()
+				}
 		}
 	
 	}
 }
 
+// IsOnline reports whether a user currently has a websocket connection
+func (h *Hub) IsOnline(userId string) bool {
+	h.clientsMutex.RLock()
+	defer h.clientsMutex.RUnlock()
+	_, ok := h.clients[userId]
+	return ok
+}
+
 func (h *Hub) RegisterMessage(message Message){
 	h.message <- message
 }
 
+func (h *Hub) RegisterNotification(notification Notification){
+	notification.Type = "app_notification"
+	h.notification <- notification
+}
+
 func (h *Hub) SendMessage(message Message, receiver *Client) {
 
 
@@ -172,6 +212,8 @@ func (h *Hub) SendMessage(message Message, receiver *Client) {
 			return 
 		}
 		log.Printf("Message delivered to %s in product %s", message.Receiver, message.ProductId)
+	} else if message.Silent {
+		log.Printf("User %s muted chat notifications, message for product %s not pushed", message.Receiver, message.ProductId)
 	} else {
 		// User is online but not viewing this product chat - send as notification
 		notification := NotificationMessage{